@@ -1,7 +1,218 @@
 package cfg
 
-import ()
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 
-func readConfig() {
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
 
+const (
+	// DefaultPath is the config file read when no other path is given.
+	DefaultPath = "vms.yaml"
+
+	// EnvPrefix prefixes every environment variable override.
+	EnvPrefix = "VMS_"
+
+	defaultInsecure = true
+	defaultVMList   = "vmlist"
+	defaultLeases   = "leases.json"
+)
+
+// vCenter connection settings
+type VCenter struct {
+	Server     string `yaml:"server" json:"server" toml:"server"`
+	User       string `yaml:"user" json:"user" toml:"user"`
+	Password   string `yaml:"password" json:"password" toml:"password"`
+	Insecure   *bool  `yaml:"insecure" json:"insecure" toml:"insecure"`
+	Datacenter string `yaml:"datacenter" json:"datacenter" toml:"datacenter"`
+}
+
+// guest os login used for the post clone steps
+type Guest struct {
+	User     string `yaml:"user" json:"user" toml:"user"`
+	Password string `yaml:"password" json:"password" toml:"password"`
+}
+
+// Config is the content of the vms configuration file.
+type Config struct {
+	VCenter VCenter `yaml:"vcenter" json:"vcenter" toml:"vcenter"`
+	Guest   Guest   `yaml:"guest" json:"guest" toml:"guest"`
+	VMList  string  `yaml:"vmlist" json:"vmlist" toml:"vmlist"`
+	// Leases is the file recording the addresses handed out from ip pools
+	Leases string `yaml:"leases" json:"leases" toml:"leases"`
+}
+
+// KeyError reports a config key that is missing or holds a bad value.
+type KeyError struct {
+	Key    string
+	Reason string
+}
+
+func (e *KeyError) Error() string {
+	return fmt.Sprintf("Error config key '%s': %s", e.Key, e.Reason)
+}
+
+// env overrides, keyed by the config key they replace
+var envKeys = []string{
+	"vcenter.server",
+	"vcenter.user",
+	"vcenter.password",
+	"vcenter.insecure",
+	"vcenter.datacenter",
+	"guest.user",
+	"guest.password",
+	"vmlist",
+	"leases",
+}
+
+// Load reads the config file at path (YAML, JSON or TOML, chosen by
+// extension) and applies the VMS_* environment overrides. An empty path
+// skips the file and uses the environment only. Callers apply their own
+// overrides and then call Validate.
+func Load(path string) (*Config, error) {
+	var c Config
+	if path != "" {
+		if err := readConfig(path, &c); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.applyEnv(); err != nil {
+		return nil, err
+	}
+	c.setDefaults()
+	return &c, nil
+}
+
+// readConfig decodes the file into c, rejecting unknown keys.
+func readConfig(path string, c *Config) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Error read config: %s", err)
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(data, c)
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(c)
+	case ".toml":
+		var md toml.MetaData
+		md, err = toml.Decode(string(data), c)
+		if err == nil {
+			if undecoded := md.Undecoded(); len(undecoded) > 0 {
+				return &KeyError{Key: undecoded[0].String(), Reason: "unknown key"}
+			}
+		}
+	default:
+		return fmt.Errorf("Error read config %s: unsupported format '%s'", path, ext)
+	}
+	if err != nil {
+		return fmt.Errorf("Error parse config %s: %s", path, err)
+	}
+	return nil
+}
+
+// EnvName returns the environment variable overriding key.
+func EnvName(key string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(key, ".", "_", -1))
+}
+
+func (c *Config) applyEnv() error {
+	for _, key := range envKeys {
+		v, ok := os.LookupEnv(EnvName(key))
+		if !ok {
+			continue
+		}
+		switch key {
+		case "vcenter.server":
+			c.VCenter.Server = v
+		case "vcenter.user":
+			c.VCenter.User = v
+		case "vcenter.password":
+			c.VCenter.Password = v
+		case "vcenter.insecure":
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return &KeyError{Key: key, Reason: fmt.Sprintf("%s is not a boolean: '%s'", EnvName(key), v)}
+			}
+			c.VCenter.Insecure = &b
+		case "vcenter.datacenter":
+			c.VCenter.Datacenter = v
+		case "guest.user":
+			c.Guest.User = v
+		case "guest.password":
+			c.Guest.Password = v
+		case "vmlist":
+			c.VMList = v
+		case "leases":
+			c.Leases = v
+		}
+	}
+	return nil
+}
+
+func (c *Config) setDefaults() {
+	if c.VCenter.Insecure == nil {
+		b := defaultInsecure
+		c.VCenter.Insecure = &b
+	}
+	if c.VMList == "" {
+		c.VMList = defaultVMList
+	}
+	if c.Leases == "" {
+		c.Leases = defaultLeases
+	}
+}
+
+// Validate checks that every key needed to reach vCenter is set.
+func (c *Config) Validate() error {
+	err := required(map[string]string{
+		"vcenter.server":   c.VCenter.Server,
+		"vcenter.user":     c.VCenter.User,
+		"vcenter.password": c.VCenter.Password,
+	})
+	if err != nil {
+		return err
+	}
+	if strings.Contains(c.VCenter.Server, "/") {
+		return &KeyError{Key: "vcenter.server", Reason: "must be a host name or address, not a url"}
+	}
+	return nil
+}
+
+// ValidateGuest checks the guest login needed by the post clone steps.
+func (c *Config) ValidateGuest() error {
+	return required(map[string]string{
+		"guest.user":     c.Guest.User,
+		"guest.password": c.Guest.Password,
+	})
+}
+
+// required returns a KeyError for the first empty key, in envKeys order.
+func required(values map[string]string) error {
+	for _, key := range envKeys {
+		v, ok := values[key]
+		if ok && strings.TrimSpace(v) == "" {
+			return &KeyError{Key: key, Reason: "is required (or set " + EnvName(key) + ")"}
+		}
+	}
+	return nil
+}
+
+// IsInsecure reports whether the vCenter certificate check is skipped.
+func (c *Config) IsInsecure() bool {
+	if c.VCenter.Insecure == nil {
+		return defaultInsecure
+	}
+	return *c.VCenter.Insecure
 }
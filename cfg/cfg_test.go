@@ -0,0 +1,183 @@
+package cfg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes content to a file called name in a new temporary
+// directory and returns its path and a func removing the directory.
+func writeConfig(t *testing.T, name, content string) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+// setEnv sets the environment overrides in env and returns a func
+// restoring the environment.
+func setEnv(env map[string]string) func() {
+	for k, v := range env {
+		os.Setenv(k, v)
+	}
+	return func() {
+		for k := range env {
+			os.Unsetenv(k)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		env     map[string]string
+		want    Config
+		err     string
+	}{
+		{
+			name:    "yaml",
+			file:    "vms.yaml",
+			content: "vcenter:\n  server: vc.lab\n  user: admin\n  password: pw\n  insecure: false\nguest:\n  user: root\n",
+			want:    Config{VCenter: VCenter{Server: "vc.lab", User: "admin", Password: "pw"}, Guest: Guest{User: "root"}, VMList: "vmlist", Leases: "leases.json"},
+		},
+		{
+			name:    "json",
+			file:    "vms.json",
+			content: `{"vcenter": {"server": "vc.lab"}, "vmlist": "lab.yaml"}`,
+			want:    Config{VCenter: VCenter{Server: "vc.lab"}, VMList: "lab.yaml", Leases: "leases.json"},
+		},
+		{
+			name:    "toml",
+			file:    "vms.toml",
+			content: "leases = \"/var/lib/vms/leases.json\"\n[vcenter]\nserver = \"vc.lab\"\n",
+			want:    Config{VCenter: VCenter{Server: "vc.lab"}, VMList: "vmlist", Leases: "/var/lib/vms/leases.json"},
+		},
+		{
+			name:    "env overrides the file",
+			file:    "vms.yaml",
+			content: "vcenter:\n  server: vc.lab\n  user: admin\n",
+			env:     map[string]string{"VMS_VCENTER_USER": "ops", "VMS_GUEST_PASSWORD": "secret"},
+			want:    Config{VCenter: VCenter{Server: "vc.lab", User: "ops"}, Guest: Guest{Password: "secret"}, VMList: "vmlist", Leases: "leases.json"},
+		},
+		{
+			name: "env only",
+			env:  map[string]string{"VMS_VCENTER_SERVER": "vc.lab", "VMS_VCENTER_INSECURE": "false"},
+			want: Config{VCenter: VCenter{Server: "vc.lab"}, VMList: "vmlist", Leases: "leases.json"},
+		},
+		{
+			name: "bad boolean",
+			env:  map[string]string{"VMS_VCENTER_INSECURE": "maybe"},
+			err:  "is not a boolean",
+		},
+		{
+			name:    "unknown yaml key",
+			file:    "vms.yaml",
+			content: "vcenter:\n  host: vc.lab\n",
+			err:     "Error parse config",
+		},
+		{
+			name:    "unknown json key",
+			file:    "vms.json",
+			content: `{"vcentre": {}}`,
+			err:     "unknown field",
+		},
+		{
+			name:    "unknown toml key",
+			file:    "vms.toml",
+			content: "[vcenter]\nhost = \"vc.lab\"\n",
+			err:     "vcenter.host",
+		},
+		{
+			name:    "unsupported format",
+			file:    "vms.ini",
+			content: "server=vc.lab\n",
+			err:     "unsupported format '.ini'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := ""
+			if tt.file != "" {
+				var cleanup func()
+				path, cleanup = writeConfig(t, tt.file, tt.content)
+				defer cleanup()
+			}
+			defer setEnv(tt.env)()
+
+			c, err := Load(path)
+			switch {
+			case tt.err != "":
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, want one with %q", err, tt.err)
+				}
+				return
+			case err != nil:
+				t.Fatal(err)
+			}
+
+			// insecure defaults to true unless the file or env says false
+			insecure := !strings.Contains(tt.content, "insecure: false") && tt.env["VMS_VCENTER_INSECURE"] != "false"
+			if c.IsInsecure() != insecure {
+				t.Errorf("insecure %v, want %v", c.IsInsecure(), insecure)
+			}
+			c.VCenter.Insecure = nil
+			if *c != tt.want {
+				t.Errorf("got %+v, want %+v", *c, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	if _, err := Load(filepath.Join(os.TempDir(), "no-such-dir", "vms.yaml")); err == nil || !strings.Contains(err.Error(), "Error read config") {
+		t.Errorf("error %v, want a read error", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		vcenter VCenter
+		err     string
+	}{
+		{"complete", VCenter{Server: "vc.lab", User: "admin", Password: "pw"}, ""},
+		{"no server", VCenter{User: "admin", Password: "pw"}, "'vcenter.server': is required (or set VMS_VCENTER_SERVER)"},
+		{"blank password", VCenter{Server: "vc.lab", User: "admin", Password: " "}, "'vcenter.password'"},
+		{"url", VCenter{Server: "https://vc.lab/sdk", User: "admin", Password: "pw"}, "not a url"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := (&Config{VCenter: tt.vcenter}).Validate()
+			if (err == nil) != (tt.err == "") || (err != nil && !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestValidateGuest(t *testing.T) {
+	if err := (&Config{Guest: Guest{User: "root"}}).ValidateGuest(); err == nil || !strings.Contains(err.Error(), "guest.password") {
+		t.Errorf("error %v, want a missing guest.password", err)
+	}
+	if err := (&Config{Guest: Guest{User: "root", Password: "pw"}}).ValidateGuest(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	if got := EnvName("vcenter.insecure"); got != "VMS_VCENTER_INSECURE" {
+		t.Errorf("got %s", got)
+	}
+}
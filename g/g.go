@@ -1,3 +0,0 @@
-package g
-
-var Gret bool = true
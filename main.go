@@ -1,9 +1,500 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+
+	"xlei/vmMulti/cfg"
 	vm "xlei/vmMulti/virtualmachine"
+
+	"github.com/Masterminds/glide/msg"
+	"github.com/codegangsta/cli"
+	"golang.org/x/net/context"
+)
+
+// exit codes
+const (
+	exitFailed     = 1 // one or more vms failed
+	exitUsage      = 2 // bad command line
+	exitConfig     = 3 // bad or incomplete config or manifest
+	exitPermission = 4 // vCenter refused the credentials
+	exitCanceled   = 130
 )
 
+// ctx is cancelled on the first SIGINT/SIGTERM, a second one exits at once.
+var ctx context.Context
+
+func handleSignals(cancel context.CancelFunc) {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		msg.Warn("interrupted, cancelling running tasks (again to quit now)")
+		cancel()
+		<-sigs
+		os.Exit(exitCanceled)
+	}()
+}
+
 func main() {
-	vm.CloneVM()
+	var cancel context.CancelFunc
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	handleSignals(cancel)
+
+	app := cli.NewApp()
+	app.Name = "vms"
+	app.Usage = "clone and manage vSphere virtual machines"
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "config, c",
+			Value:  cfg.DefaultPath,
+			Usage:  "config file (yaml, json or toml)",
+			EnvVar: cfg.EnvPrefix + "CONFIG",
+		},
+		cli.StringFlag{
+			Name:  "server, s",
+			Usage: "vCenter server, overrides " + cfg.EnvName("vcenter.server"),
+		},
+		cli.StringFlag{
+			Name:  "user, u",
+			Usage: "vCenter user, overrides " + cfg.EnvName("vcenter.user"),
+		},
+		cli.StringFlag{
+			Name:  "datacenter",
+			Usage: "datacenter to work in when the vmlist names none, overrides " + cfg.EnvName("vcenter.datacenter"),
+		},
+		cli.BoolFlag{
+			Name:  "insecure, k",
+			Usage: "skip vCenter certificate verification",
+		},
+	}
+	app.Commands = []cli.Command{
+		{
+			Name:  "clone",
+			Usage: "clone every vm in a manifest or vmlist",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "file, f",
+					Usage: "manifest (yaml/json) or legacy vmlist, defaults to the vmlist config key",
+				},
+				cli.IntFlag{
+					Name:  "parallel, p",
+					Value: 4,
+					Usage: "clones in flight",
+				},
+				cli.IntFlag{
+					Name:  "per-datastore",
+					Usage: "clones in flight per datastore, 0 for no cap",
+				},
+				cli.IntFlag{
+					Name:  "per-host",
+					Usage: "clones in flight per host, 0 for no cap; drs placed vms are not capped",
+				},
+				cli.BoolFlag{
+					Name:  "keep-on-failure",
+					Usage: "keep the vm of a failed clone instead of destroying it",
+				},
+				cli.BoolFlag{
+					Name:  "ensure",
+					Usage: "reconcile vms that already exist instead of failing on them",
+				},
+				cli.BoolFlag{
+					Name:  "plan",
+					Usage: "report what --ensure would create or change without doing it",
+				},
+				cli.BoolFlag{
+					Name:  "restart",
+					Usage: "let --ensure power off vms for vcpu and memory changes they cannot take running",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "resolve and check every vm and print the plan, clone nothing",
+				},
+				cli.StringFlag{
+					Name:  "report",
+					Usage: "also write a json or csv report of every vm",
+				},
+				cli.StringFlag{
+					Name:  "report-file",
+					Usage: "file for --report, stdout when empty",
+				},
+				cli.DurationFlag{
+					Name:  "clone-timeout",
+					Value: vm.DefaultTimeouts.Clone,
+					Usage: "deadline of each clone task, 0 for none",
+				},
+				cli.DurationFlag{
+					Name:  "poweron-timeout",
+					Value: vm.DefaultTimeouts.PowerOn,
+					Usage: "deadline for a new vm to power on, 0 for none",
+				},
+				cli.DurationFlag{
+					Name:  "tools-timeout",
+					Value: vm.DefaultTimeouts.Tools,
+					Usage: "deadline for VMware Tools to start in the guest, 0 for none",
+				},
+				cli.DurationFlag{
+					Name:  "ip-timeout",
+					Value: vm.DefaultTimeouts.IP,
+					Usage: "deadline for the guest to report its ip, 0 for none",
+				},
+				cli.DurationFlag{
+					Name:  "command-timeout",
+					Value: vm.DefaultTimeouts.Commands,
+					Usage: "deadline for the post commands of a vm, 0 for none",
+				},
+			},
+			Action: cloneAction,
+		},
+		{
+			Name:      "ls",
+			Aliases:   []string{"list"},
+			Usage:     "list vms",
+			ArgsUsage: "[pattern]",
+			Action:    listAction,
+		},
+		{
+			Name:      "power",
+			Usage:     "power vms on, off or reset them",
+			ArgsUsage: "on|off|reset NAME...",
+			Action:    powerAction,
+		},
+		{
+			Name:      "status",
+			Usage:     "show power and guest state of vms",
+			ArgsUsage: "NAME...",
+			Action:    statusAction,
+		},
+		{
+			Name:      "destroy",
+			Usage:     "power off and delete vms",
+			ArgsUsage: "NAME...",
+			Action:    destroyAction,
+		},
+		{
+			Name:  "spec",
+			Usage: "manage vCenter customization specs",
+			Subcommands: []cli.Command{
+				{
+					Name:    "ls",
+					Aliases: []string{"list"},
+					Usage:   "list customization specs",
+					Action:  specListAction,
+				},
+				{
+					Name:      "export",
+					Usage:     "write a customization spec as xml",
+					ArgsUsage: "NAME [FILE]",
+					Action:    specExportAction,
+				},
+				{
+					Name:      "import",
+					Usage:     "create a customization spec from an exported xml file",
+					ArgsUsage: "FILE [NAME]",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "force",
+							Usage: "replace a spec of the same name",
+						},
+					},
+					Action: specImportAction,
+				},
+			},
+		},
+	}
+
+	// actions exit through their ExitError, what is left are bad flags
+	// and unknown commands
+	if err := app.Run(os.Args); err != nil {
+		if e, ok := err.(cli.ExitCoder); ok {
+			os.Exit(e.ExitCode())
+		}
+		os.Exit(exitUsage)
+	}
+}
+
+// loadConfig reads the config file and applies the global flags on top.
+func loadConfig(c *cli.Context) (*cfg.Config, error) {
+	path := c.GlobalString("config")
+	if !c.GlobalIsSet("config") {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			// no default file, rely on the environment
+			path = ""
+		}
+	}
+
+	conf, err := cfg.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	if v := c.GlobalString("server"); v != "" {
+		conf.VCenter.Server = v
+	}
+	if v := c.GlobalString("user"); v != "" {
+		conf.VCenter.User = v
+	}
+	if v := c.GlobalString("datacenter"); v != "" {
+		conf.VCenter.Datacenter = v
+	}
+	if c.GlobalBool("insecure") {
+		insecure := true
+		conf.VCenter.Insecure = &insecure
+	}
+	return conf, conf.Validate()
+}
+
+// vmConfig builds the virtualmachine config from conf.
+func vmConfig(conf *cfg.Config) *vm.Config {
+	return &vm.Config{
+		User:          conf.VCenter.User,
+		Password:      conf.VCenter.Password,
+		VCenterServer: conf.VCenter.Server,
+		Insecure:      conf.IsInsecure(),
+		Datacenter:    conf.VCenter.Datacenter,
+		GuestUser:     conf.Guest.User,
+		GuestPassword: conf.Guest.Password,
+		LeaseFile:     conf.Leases,
+	}
+}
+
+func cloneAction(c *cli.Context) error {
+	conf, err := loadConfig(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitConfig)
+	}
+	path := c.String("file")
+	if path == "" {
+		path = conf.VMList
+	}
+	if c.Bool("dry-run") {
+		return dryRun(conf, path)
+	}
+	if c.Int("parallel") < 1 || c.Int("per-datastore") < 0 || c.Int("per-host") < 0 {
+		return cli.NewExitError("--parallel must be at least 1 and the caps not negative", exitUsage)
+	}
+	format := c.String("report")
+	switch format {
+	case "", vm.ReportJSON, vm.ReportCSV:
+	default:
+		return cli.NewExitError("--report must be json or csv", exitUsage)
+	}
+	opts := vm.CloneOptions{
+		Parallel:      c.Int("parallel"),
+		PerDatastore:  c.Int("per-datastore"),
+		PerHost:       c.Int("per-host"),
+		KeepOnFailure: c.Bool("keep-on-failure"),
+		Ensure:        c.Bool("ensure") || c.Bool("plan"),
+		Plan:          c.Bool("plan"),
+		Restart:       c.Bool("restart"),
+		Timeouts: vm.Timeouts{
+			Clone:   c.Duration("clone-timeout"),
+			PowerOn: c.Duration("poweron-timeout"),
+			Tools:   c.Duration("tools-timeout"),
+			IP:      c.Duration("ip-timeout"),
+
+			Commands: c.Duration("command-timeout"),
+		},
+	}
+
+	results, err := vm.CloneVM(ctx, vmConfig(conf), path, opts)
+	if results != nil {
+		// the table goes with the logs, stdout stays machine readable
+		vm.WriteSummary(os.Stderr, results)
+		if format != "" {
+			if rerr := writeReport(c.String("report-file"), format, results); rerr != nil {
+				return cli.NewExitError(rerr.Error(), exitFailed)
+			}
+		}
+	}
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitCode(err))
+	}
+	return nil
+}
+
+// dryRun prints what a clone of path would do.
+func dryRun(conf *cfg.Config, path string) error {
+	results, err := vm.DryRun(ctx, vmConfig(conf), path)
+	if results != nil {
+		vm.WriteDryRun(os.Stdout, results)
+	}
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitCode(err))
+	}
+	return nil
+}
+
+// writeReport writes the clone report to path, or stdout when path is empty.
+func writeReport(path, format string, results []vm.CloneResult) error {
+	if path == "" {
+		return vm.WriteReport(os.Stdout, format, results)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := vm.WriteReport(f, format, results); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func listAction(c *cli.Context) error {
+	if c.NArg() > 1 {
+		return cli.NewExitError("ls takes at most one pattern", exitUsage)
+	}
+	conf, err := loadConfig(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitConfig)
+	}
+	statuses, err := vm.ListVMs(ctx, vmConfig(conf), c.Args().First())
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitCode(err))
+	}
+	printStatuses(statuses)
+	return nil
+}
+
+func powerAction(c *cli.Context) error {
+	op := c.Args().First()
+	switch op {
+	case vm.PowerOn, vm.PowerOff, vm.PowerReset:
+	default:
+		return cli.NewExitError("usage: vms power on|off|reset NAME...", exitUsage)
+	}
+	if c.NArg() < 2 {
+		return cli.NewExitError("usage: vms power on|off|reset NAME...", exitUsage)
+	}
+	conf, err := loadConfig(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitConfig)
+	}
+	if err := vm.PowerVMs(ctx, vmConfig(conf), op, c.Args().Tail()); err != nil {
+		return cli.NewExitError(err.Error(), exitCode(err))
+	}
+	return nil
+}
+
+func statusAction(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return cli.NewExitError("usage: vms status NAME...", exitUsage)
+	}
+	conf, err := loadConfig(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitConfig)
+	}
+	statuses, err := vm.StatusVMs(ctx, vmConfig(conf), c.Args())
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitCode(err))
+	}
+	printStatuses(statuses)
+	return nil
+}
+
+func destroyAction(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return cli.NewExitError("usage: vms destroy NAME...", exitUsage)
+	}
+	conf, err := loadConfig(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitConfig)
+	}
+	if err := vm.DestroyVMs(ctx, vmConfig(conf), c.Args()); err != nil {
+		return cli.NewExitError(err.Error(), exitCode(err))
+	}
+	return nil
+}
+
+func specListAction(c *cli.Context) error {
+	conf, err := loadConfig(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitConfig)
+	}
+	specs, err := vm.ListSpecs(ctx, vmConfig(conf))
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitCode(err))
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tTYPE\tUPDATED\tDESCRIPTION")
+	for _, s := range specs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.Name, s.Type, s.LastUpdate.Format("2006-01-02 15:04"), s.Description)
+	}
+	w.Flush()
+	return nil
+}
+
+func specExportAction(c *cli.Context) error {
+	if c.NArg() < 1 || c.NArg() > 2 {
+		return cli.NewExitError("usage: vms spec export NAME [FILE]", exitUsage)
+	}
+	conf, err := loadConfig(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitConfig)
+	}
+
+	out := os.Stdout
+	if path := c.Args().Get(1); path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return cli.NewExitError(err.Error(), exitFailed)
+		}
+		defer f.Close()
+		out = f
+	}
+	if err := vm.ExportSpec(ctx, vmConfig(conf), c.Args().First(), out); err != nil {
+		return cli.NewExitError(err.Error(), exitCode(err))
+	}
+	return nil
+}
+
+func specImportAction(c *cli.Context) error {
+	if c.NArg() < 1 || c.NArg() > 2 {
+		return cli.NewExitError("usage: vms spec import FILE [NAME]", exitUsage)
+	}
+	conf, err := loadConfig(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitConfig)
+	}
+
+	f, err := os.Open(c.Args().First())
+	if err != nil {
+		return cli.NewExitError(err.Error(), exitUsage)
+	}
+	defer f.Close()
+	if err := vm.ImportSpec(ctx, vmConfig(conf), f, c.Args().Get(1), c.Bool("force")); err != nil {
+		return cli.NewExitError(err.Error(), exitCode(err))
+	}
+	return nil
+}
+
+// exitCode maps a virtualmachine error to the process exit code.
+func exitCode(err error) int {
+	switch vm.Kind(err) {
+	case vm.ErrInvalidSpec:
+		return exitConfig
+	case vm.ErrPermission:
+		return exitPermission
+	}
+	if ctx.Err() != nil {
+		return exitCanceled
+	}
+	return exitFailed
+}
+
+func printStatuses(statuses []vm.VMStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tPOWER\tIP\tGUEST\tTOOLS\tPATH")
+	for _, s := range statuses {
+		tools := "no"
+		if s.ToolsRunning {
+			tools = "yes"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", s.Name, s.PowerState, s.IPAddress, s.GuestID, tools, s.Path)
+	}
+	w.Flush()
 }
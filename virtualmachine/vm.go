@@ -18,20 +18,54 @@ type networkInterface struct {
 	label            string
 	ipv4Address      string
 	ipv4PrefixLength int
+	ipv4Pool         *ipPool // sets ipv4Address when not nil
 	ipv6Address      string
 	ipv6PrefixLength int
-	adapterType      string // default vmxnet3 ; TODO: Make "adapter_type" argument
+	ipv6AddrMode     string // see ipv6Mode
+	adapterType      string // default vmxnet3, see adapterTypes
+	macAddress       string // generated when empty
+	wakeOnLan        *bool
+	startConnected   *bool  // default true
+	gateway          string // default the vm gateway when inside the subnet
+	ipv6Gateway      string
+	routes           []staticRoute
+}
+
+// staticRoute sends the traffic for the network to (CIDR) through via.
+type staticRoute struct {
+	to  string
+	via string
 }
 
 type hardDisk struct {
-	size     int64
-	iops     int64
-	initType string
+	size      int64 // GB, grows a template disk
+	iops      int64
+	initType  string // see initThin, template disks can be linked
+	datastore string // default the vm datastore
+	diskMode  string // default persistent
+	// only for the disks added after the template ones
+	controller string // see validateDiskPlacement, default the first scsi one
+	unitNumber *int
+}
+
+// windowsOptions is the sysprep identity of a Windows guest.
+type windowsOptions struct {
+	adminPassword  string
+	fullName       string
+	orgName        string
+	productKey     string
+	workgroup      string
+	joinDomain     string
+	domainUser     string
+	domainPassword string
+	autoLogonCount int
+	runOnce        []string
 }
 
 // define the vm
 type virtualMachine struct {
 	name                       string
+	guestHostName              string // derived from name when empty
 	folder                     string
 	datacenter                 string
 	cluster                    string
@@ -41,14 +75,22 @@ type virtualMachine struct {
 	memoryMb                   int64
 	template                   string
 	networkInterfaces          []networkInterface
+	nicPolicy                  string // see nicPolicyReplace
 	hardDisks                  []hardDisk
+	linked                     bool   // every disk a child of the template snapshot
+	instant                    bool   // fork the running template, linked where it cannot
+	snapshot                   string // template snapshot of linked disks, default the current one
 	gateway                    string
+	ipv6Gateway                string
 	domain                     string
 	timeZone                   string
 	dnsSuffixes                []string
 	dnsServers                 []string
 	customConfigurations       map[string](types.AnyType)
 	customizationSpecification map[string](types.AnyType)
+	windows                    windowsOptions
+	postCommands               []string
+	shell                      string // see shellSh
 
 	host string
 }
@@ -58,6 +100,16 @@ type Config struct {
 	User          string
 	Password      string
 	VCenterServer string
+	Insecure      bool
+	Datacenter    string
+
+	// guest os login for the post clone steps
+	GuestUser     string
+	GuestPassword string
+
+	// LeaseFile records the addresses handed out from ip pools,
+	// DefaultLeaseFile when empty
+	LeaseFile string
 }
 
 //var chs []chan string = make([]chan string, 2)
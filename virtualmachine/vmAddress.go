@@ -0,0 +1,254 @@
+package virtualmachine
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// splitCIDR splits address written as 10.1.2.3/24 into the address and the
+// prefix length. An address without a prefix keeps prefix.
+func splitCIDR(address string, prefix int) (string, int, error) {
+	i := strings.Index(address, "/")
+	if i < 0 {
+		return address, prefix, nil
+	}
+	ip, ipNet, err := net.ParseCIDR(address)
+	if err != nil {
+		return "", 0, fmt.Errorf("'%s' is not an address/prefix", address)
+	}
+	ones, _ := ipNet.Mask.Size()
+	if prefix != 0 && prefix != ones {
+		return "", 0, fmt.Errorf("prefix /%d of %s conflicts with prefix length %d", ones, address, prefix)
+	}
+	return ip.String(), ones, nil
+}
+
+// inSubnet reports whether ip lies in the subnet of address/prefix.
+func inSubnet(ip, address string, prefix int) bool {
+	a, b := net.ParseIP(ip), net.ParseIP(address)
+	if a == nil || b == nil || (a.To4() == nil) != (b.To4() == nil) {
+		return false
+	}
+	bits := 128
+	if b.To4() != nil {
+		bits = 32
+	}
+	m := net.CIDRMask(prefix, bits)
+	if m == nil {
+		return false
+	}
+	return a.Mask(m).Equal(b.Mask(m))
+}
+
+// nicGateway returns the ipv4 gateway of the static nic n: its own, or the
+// vm gateway when that lies inside the nic subnet. A vm on several
+// networks so only gets a default route where the gateway is reachable.
+func (vm *virtualMachine) nicGateway(n networkInterface) string {
+	if n.ipv4Address == "" {
+		return ""
+	}
+	if n.gateway != "" {
+		return n.gateway
+	}
+	if inSubnet(vm.gateway, n.ipv4Address, n.ipv4PrefixLength) {
+		return vm.gateway
+	}
+	return ""
+}
+
+// nicIPv6Gateway is nicGateway for ipv6. A link-local vm gateway cannot be
+// placed by subnet and goes to the first nic with a static ipv6 address.
+func (vm *virtualMachine) nicIPv6Gateway(n networkInterface) string {
+	if n.ipv6Mode() != ipv6Static {
+		return ""
+	}
+	if n.ipv6Gateway != "" {
+		return n.ipv6Gateway
+	}
+	if inSubnet(vm.ipv6Gateway, n.ipv6Address, n.ipv6PrefixLength) {
+		return vm.ipv6Gateway
+	}
+	if ip := net.ParseIP(vm.ipv6Gateway); ip != nil && ip.IsLinkLocalUnicast() {
+		for _, other := range vm.networkInterfaces {
+			if other.ipv6Mode() == ipv6Static {
+				if other.ipv6Address == n.ipv6Address {
+					return vm.ipv6Gateway
+				}
+				break
+			}
+		}
+	}
+	return ""
+}
+
+// validateNetwork checks the ip settings of every nic of vm: the
+// addresses, that every gateway and route lies inside a nic subnet, and
+// that the vm gateway is reachable from some nic.
+func (vm *virtualMachine) validateNetwork() []error {
+	var errs []error
+	invalid := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+	isIPv4 := func(s string) bool {
+		ip := net.ParseIP(s)
+		return ip != nil && ip.To4() != nil
+	}
+	isIPv6 := func(s string) bool {
+		ip := net.ParseIP(s)
+		return ip != nil && ip.To4() == nil
+	}
+
+	var v4Gateway, v6Gateway, staticV4, staticV6 bool
+	for i, n := range vm.networkInterfaces {
+		// a pool nic is checked again once it has its address
+		pending := n.ipv4Pool != nil && n.ipv4Address == ""
+		if n.ipv4Address != "" {
+			staticV4 = true
+			if !isIPv4(n.ipv4Address) {
+				invalid("networkInterfaces[%d]: '%s' is not an ipv4 address", i, n.ipv4Address)
+			}
+			if n.ipv4PrefixLength < 1 || n.ipv4PrefixLength > 32 {
+				invalid("networkInterfaces[%d]: ipv4PrefixLength %d is not between 1 and 32", i, n.ipv4PrefixLength)
+			}
+		}
+		if n.ipv6Address != "" {
+			staticV6 = true
+			if !isIPv6(n.ipv6Address) {
+				invalid("networkInterfaces[%d]: '%s' is not an ipv6 address", i, n.ipv6Address)
+			}
+			if n.ipv6PrefixLength < 1 || n.ipv6PrefixLength > 128 {
+				invalid("networkInterfaces[%d]: ipv6PrefixLength %d is not between 1 and 128", i, n.ipv6PrefixLength)
+			}
+		}
+
+		switch {
+		case n.gateway == "", pending:
+		case n.ipv4Address == "":
+			invalid("networkInterfaces[%d]: gateway needs a static ipv4Address", i)
+		case !isIPv4(n.gateway):
+			invalid("networkInterfaces[%d]: gateway '%s' is not an ipv4 address", i, n.gateway)
+		case !inSubnet(n.gateway, n.ipv4Address, n.ipv4PrefixLength):
+			invalid("networkInterfaces[%d]: gateway %s is outside %s/%d", i, n.gateway, n.ipv4Address, n.ipv4PrefixLength)
+		}
+		switch {
+		case n.ipv6Gateway == "":
+		case n.ipv6Mode() != ipv6Static:
+			invalid("networkInterfaces[%d]: ipv6Gateway needs a static ipv6Address", i)
+		case !isIPv6(n.ipv6Gateway):
+			invalid("networkInterfaces[%d]: ipv6Gateway '%s' is not an ipv6 address", i, n.ipv6Gateway)
+		case !net.ParseIP(n.ipv6Gateway).IsLinkLocalUnicast() && !inSubnet(n.ipv6Gateway, n.ipv6Address, n.ipv6PrefixLength):
+			invalid("networkInterfaces[%d]: ipv6Gateway %s is outside %s/%d", i, n.ipv6Gateway, n.ipv6Address, n.ipv6PrefixLength)
+		}
+		if n.gateway == "" && vm.nicGateway(n) != "" {
+			v4Gateway = true
+		}
+		if n.ipv6Gateway == "" && vm.nicIPv6Gateway(n) != "" {
+			v6Gateway = true
+		}
+
+		for j, r := range n.routes {
+			_, to, err := net.ParseCIDR(r.to)
+			if err != nil {
+				invalid("networkInterfaces[%d].routes[%d]: to '%s' is not a network/prefix", i, j, r.to)
+				continue
+			}
+			if pending && to.IP.To4() != nil {
+				continue
+			}
+			address, prefix := n.ipv4Address, n.ipv4PrefixLength
+			if to.IP.To4() == nil {
+				address, prefix = n.ipv6Address, n.ipv6PrefixLength
+			}
+			switch {
+			case address == "":
+				invalid("networkInterfaces[%d].routes[%d]: route to %s needs a static address of its family", i, j, r.to)
+			case !inSubnet(r.via, address, prefix):
+				invalid("networkInterfaces[%d].routes[%d]: via '%s' is outside %s/%d", i, j, r.via, address, prefix)
+			}
+		}
+	}
+
+	if vm.gateway != "" {
+		switch {
+		case !isIPv4(vm.gateway):
+			invalid("gateway '%s' is not an ipv4 address", vm.gateway)
+		case staticV4 && !v4Gateway && !vm.allNICGateways(false):
+			invalid("gateway %s is outside the subnet of every static nic", vm.gateway)
+		}
+	}
+	if vm.ipv6Gateway != "" {
+		switch {
+		case !isIPv6(vm.ipv6Gateway):
+			invalid("ipv6Gateway '%s' is not an ipv6 address", vm.ipv6Gateway)
+		case staticV6 && !v6Gateway && !vm.allNICGateways(true):
+			invalid("ipv6Gateway %s is outside the subnet of every static nic", vm.ipv6Gateway)
+		}
+	}
+	return errs
+}
+
+// allNICGateways reports whether every static nic of vm sets its own
+// gateway, ipv6 or ipv4, so the vm gateway is only a default for others.
+func (vm *virtualMachine) allNICGateways(ipv6 bool) bool {
+	for _, n := range vm.networkInterfaces {
+		if ipv6 && n.ipv6Mode() == ipv6Static && n.ipv6Gateway == "" {
+			return false
+		}
+		if !ipv6 && n.ipv4Address != "" && n.gateway == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// routeCommands returns the guest commands that add the static routes of
+// vm and keep them over a reboot.
+func (vm *virtualMachine) routeCommands(windows bool) []string {
+	var commands []string
+	for _, n := range vm.networkInterfaces {
+		for _, r := range n.routes {
+			_, to, err := net.ParseCIDR(r.to)
+			if err != nil {
+				continue
+			}
+			ipv6 := to.IP.To4() == nil
+			if windows {
+				commands = append(commands, windowsRoute(to, r.via, ipv6))
+				continue
+			}
+			address := n.ipv4Address
+			if ipv6 {
+				address = n.ipv6Address
+			}
+			commands = append(commands, linuxRoute(to, r.via, net.ParseIP(address).String(), ipv6))
+		}
+	}
+	return commands
+}
+
+func windowsRoute(to *net.IPNet, via string, ipv6 bool) string {
+	if ipv6 {
+		return fmt.Sprintf("route -p add %s %s", to, via)
+	}
+	m := to.Mask
+	return fmt.Sprintf("route -p add %s mask %s %s", to.IP, net.IPv4(m[0], m[1], m[2], m[3]), via)
+}
+
+// linuxRoute adds the route on the device that holds address, and writes
+// it to the route file of the device on guests with network-scripts.
+func linuxRoute(to *net.IPNet, via, address string, ipv6 bool) string {
+	ip, file := "ip", "route-"
+	if ipv6 {
+		ip, file = "ip -6", "route6-"
+	}
+	route := fmt.Sprintf("%s via %s", to, via)
+	return strings.Join([]string{
+		"dev=$(ip -o addr show | awk '{ if (index($4, " + strconv.Quote(address+"/") + ") == 1) { print $2; exit } }')",
+		`[ -n "$dev" ] || { echo "no device has ` + address + `" >&2; exit 1; }`,
+		fmt.Sprintf(`%s route replace %s dev "$dev"`, ip, route),
+		"f=/etc/sysconfig/network-scripts/" + file + "$dev",
+		`if [ -d /etc/sysconfig/network-scripts ] && ! grep -qxF "` + route + ` dev $dev" "$f" 2>/dev/null; then echo "` + route + ` dev $dev" >> "$f"; fi`,
+	}, "; ")
+}
@@ -0,0 +1,227 @@
+package virtualmachine
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitCIDR(t *testing.T) {
+	tests := []struct {
+		address string
+		prefix  int
+		ip      string
+		ones    int
+		err     string
+	}{
+		{"10.1.2.3", 24, "10.1.2.3", 24, ""},
+		{"10.1.2.3", 0, "10.1.2.3", 0, ""},
+		{"10.1.2.3/24", 0, "10.1.2.3", 24, ""},
+		{"10.1.2.3/24", 24, "10.1.2.3", 24, ""},
+		{"10.1.2.3/24", 16, "", 0, "conflicts with prefix length 16"},
+		{"fd00::5/64", 0, "fd00::5", 64, ""},
+		{"10.1.2.3/33", 0, "", 0, "is not an address/prefix"},
+		{"host/24", 0, "", 0, "is not an address/prefix"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			ip, ones, err := splitCIDR(tt.address, tt.prefix)
+			checkErr(t, err, tt.err)
+			if ip != tt.ip || ones != tt.ones {
+				t.Errorf("got %s/%d, want %s/%d", ip, ones, tt.ip, tt.ones)
+			}
+		})
+	}
+}
+
+func TestInSubnet(t *testing.T) {
+	tests := []struct {
+		ip, address string
+		prefix      int
+		want        bool
+	}{
+		{"10.1.2.1", "10.1.2.3", 24, true},
+		{"10.1.3.1", "10.1.2.3", 24, false},
+		{"10.1.3.1", "10.1.2.3", 16, true},
+		{"fd00::1", "fd00::5", 64, true},
+		{"fd01::1", "fd00::5", 64, false},
+		{"10.1.2.1", "fd00::5", 64, false},
+		{"10.1.2.1", "10.1.2.3", 33, false},
+		{"", "10.1.2.3", 24, false},
+	}
+	for _, tt := range tests {
+		if got := inSubnet(tt.ip, tt.address, tt.prefix); got != tt.want {
+			t.Errorf("inSubnet(%s, %s/%d) = %v, want %v", tt.ip, tt.address, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestNICGateway(t *testing.T) {
+	tests := []struct {
+		name string
+		nic  networkInterface
+		want string
+	}{
+		{"dhcp", networkInterface{}, ""},
+		{"vm gateway in subnet", networkInterface{ipv4Address: "10.1.2.3", ipv4PrefixLength: 24}, "10.1.2.1"},
+		{"vm gateway outside", networkInterface{ipv4Address: "10.1.9.3", ipv4PrefixLength: 24}, ""},
+		{"own gateway", networkInterface{ipv4Address: "10.1.9.3", ipv4PrefixLength: 24, gateway: "10.1.9.1"}, "10.1.9.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := &virtualMachine{gateway: "10.1.2.1"}
+			if got := vm.nicGateway(tt.nic); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNICIPv6Gateway(t *testing.T) {
+	first := networkInterface{ipv6Address: "fd00::5", ipv6PrefixLength: 64}
+	second := networkInterface{ipv6Address: "fd01::5", ipv6PrefixLength: 64}
+	tests := []struct {
+		name    string
+		gateway string
+		nic     networkInterface
+		want    string
+	}{
+		{"slaac", "fd00::1", networkInterface{ipv6AddrMode: ipv6SLAAC}, ""},
+		{"vm gateway in subnet", "fd00::1", first, "fd00::1"},
+		{"vm gateway outside", "fd00::1", second, ""},
+		{"own gateway", "fd00::1", networkInterface{ipv6Address: "fd01::5", ipv6PrefixLength: 64, ipv6Gateway: "fd01::1"}, "fd01::1"},
+		{"link-local on the first static nic", "fe80::1", first, "fe80::1"},
+		{"link-local not on later nics", "fe80::1", second, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := &virtualMachine{ipv6Gateway: tt.gateway, networkInterfaces: []networkInterface{{}, first, second}}
+			if got := vm.nicIPv6Gateway(tt.nic); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateNetwork(t *testing.T) {
+	static := networkInterface{ipv4Address: "10.1.2.3", ipv4PrefixLength: 24}
+	tests := []struct {
+		name    string
+		vm      virtualMachine
+		wantErr []string // one substring per error
+	}{
+		{"dhcp", virtualMachine{networkInterfaces: []networkInterface{{}}}, nil},
+		{"static", virtualMachine{gateway: "10.1.2.1", networkInterfaces: []networkInterface{static}}, nil},
+		{
+			"bad address and prefix",
+			virtualMachine{networkInterfaces: []networkInterface{{ipv4Address: "fd00::5", ipv4PrefixLength: 40}}},
+			[]string{"is not an ipv4 address", "not between 1 and 32"},
+		},
+		{
+			"gateway without address",
+			virtualMachine{networkInterfaces: []networkInterface{{gateway: "10.1.2.1"}}},
+			[]string{"gateway needs a static ipv4Address"},
+		},
+		{
+			"nic gateway outside",
+			virtualMachine{networkInterfaces: []networkInterface{{ipv4Address: "10.1.2.3", ipv4PrefixLength: 24, gateway: "10.1.3.1"}}},
+			[]string{"gateway 10.1.3.1 is outside 10.1.2.3/24"},
+		},
+		{
+			"pool nic gateway checked later",
+			virtualMachine{networkInterfaces: []networkInterface{{ipv4Pool: &ipPool{}, gateway: "10.1.2.1"}}},
+			nil,
+		},
+		{
+			"vm gateway unreachable",
+			virtualMachine{gateway: "10.1.9.1", networkInterfaces: []networkInterface{static}},
+			[]string{"gateway 10.1.9.1 is outside the subnet of every static nic"},
+		},
+		{
+			"vm gateway a default for nics with their own",
+			virtualMachine{gateway: "10.1.9.1", networkInterfaces: []networkInterface{{ipv4Address: "10.1.2.3", ipv4PrefixLength: 24, gateway: "10.1.2.1"}}},
+			nil,
+		},
+		{
+			"link-local ipv6 gateway",
+			virtualMachine{ipv6Gateway: "fe80::1", networkInterfaces: []networkInterface{{ipv6Address: "fd00::5", ipv6PrefixLength: 64}}},
+			nil,
+		},
+		{
+			"ipv6 gateway on slaac nic",
+			virtualMachine{networkInterfaces: []networkInterface{{ipv6AddrMode: ipv6SLAAC, ipv6Gateway: "fd00::1"}}},
+			[]string{"ipv6Gateway needs a static ipv6Address"},
+		},
+		{
+			"routes",
+			virtualMachine{networkInterfaces: []networkInterface{{
+				ipv4Address: "10.1.2.3", ipv4PrefixLength: 24,
+				routes: []staticRoute{{to: "10.8.0.0/16", via: "10.1.2.254"}, {to: "10.9.0.0/16", via: "10.1.3.254"}, {to: "fd08::/32", via: "fd00::1"}, {to: "10.10.0.0"}},
+			}}},
+			[]string{"routes[1]: via '10.1.3.254' is outside", "routes[2]: route to fd08::/32 needs a static address", "routes[3]: to '10.10.0.0' is not a network/prefix"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := tt.vm.validateNetwork()
+			if len(errs) != len(tt.wantErr) {
+				t.Fatalf("got %v, want %d errors", errs, len(tt.wantErr))
+			}
+			for i, err := range errs {
+				if !strings.Contains(err.Error(), tt.wantErr[i]) {
+					t.Errorf("error %q, want one with %q", err, tt.wantErr[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRouteCommands(t *testing.T) {
+	vm := &virtualMachine{networkInterfaces: []networkInterface{
+		{},
+		{
+			ipv4Address: "10.1.2.3", ipv4PrefixLength: 24, ipv6Address: "fd00::5", ipv6PrefixLength: 64,
+			routes: []staticRoute{{to: "10.8.0.0/16", via: "10.1.2.254"}, {to: "fd08::/32", via: "fd00::1"}},
+		},
+	}}
+
+	windows := vm.routeCommands(true)
+	want := []string{"route -p add 10.8.0.0 mask 255.255.0.0 10.1.2.254", "route -p add fd08::/32 fd00::1"}
+	if !reflect.DeepEqual(windows, want) {
+		t.Errorf("windows got %q, want %q", windows, want)
+	}
+
+	linux := vm.routeCommands(false)
+	if len(linux) != 2 {
+		t.Fatalf("linux got %q, want 2 commands", linux)
+	}
+	for i, want := range []string{`"10.1.2.3/"`, `ip route replace 10.8.0.0/16 via 10.1.2.254 dev "$dev"`, "route-$dev"} {
+		if !strings.Contains(linux[0], want) {
+			t.Errorf("ipv4 command part %d %q missing from %s", i, want, linux[0])
+		}
+	}
+	for i, want := range []string{`"fd00::5/"`, `ip -6 route replace fd08::/32 via fd00::1 dev "$dev"`, "route6-$dev"} {
+		if !strings.Contains(linux[1], want) {
+			t.Errorf("ipv6 command part %d %q missing from %s", i, want, linux[1])
+		}
+	}
+}
+
+func TestStaticIPs(t *testing.T) {
+	vm := &virtualMachine{networkInterfaces: []networkInterface{
+		{},
+		{ipv4Address: "10.1.2.3"},
+		{ipv6Address: "fd00::5", ipv6AddrMode: ipv6Static},
+		{ipv4Address: "10.1.3.3", ipv6Address: "fd01::5"},
+		{ipv6AddrMode: ipv6SLAAC},
+	}}
+	want := []string{"10.1.2.3", "fd00::5", "10.1.3.3", "fd01::5"}
+	if got := vm.staticIPs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for i, static := range []bool{false, true, true, true, false} {
+		if got := vm.networkInterfaces[i].static(); got != static {
+			t.Errorf("networkInterfaces[%d].static() = %v, want %v", i, got, static)
+		}
+	}
+}
@@ -6,15 +6,12 @@ import (
 	"net/url"
 
 	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/vim25/types"
 	"golang.org/x/net/context"
 )
 
-const (
-	defaultInsecureFlag = true
-)
-
 // Client() returns a new client for accessing VMWare vSphere.
-func (c *Config) Client() (*govmomi.Client, error) {
+func (c *Config) Client(ctx context.Context) (*govmomi.Client, error) {
 	u, err := url.Parse("https://" + c.VCenterServer + "/sdk")
 	if err != nil {
 		return nil, fmt.Errorf("Error parse url: %s", err)
@@ -22,12 +19,20 @@ func (c *Config) Client() (*govmomi.Client, error) {
 
 	u.User = url.UserPassword(c.User, c.Password)
 
-	client, err := govmomi.NewClient(context.TODO(), u, defaultInsecureFlag)
+	client, err := govmomi.NewClient(ctx, u, c.Insecure)
 	if err != nil {
-		return nil, fmt.Errorf("Error setting up client: %s", err)
+		return nil, newError(ErrUnknown, "", "connect to "+c.VCenterServer, err)
 	}
 
 	//log.Printf("[INFO] VMWare vSphere Client configured for URL: %s", u)
 
 	return client, nil
 }
+
+// guestAuth returns the login used for guest operations.
+func (c *Config) guestAuth() *types.NamePasswordAuthentication {
+	return &types.NamePasswordAuthentication{
+		Username: c.GuestUser,
+		Password: c.GuestPassword,
+	}
+}
@@ -3,20 +3,13 @@ package virtualmachine
 import (
 	"fmt"
 	"io/ioutil"
-	"log"
-	"net"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
-	"xlei/vmMulti/g"
-
 	"github.com/vmware/govmomi"
 	"github.com/vmware/govmomi/find"
-	"github.com/vmware/govmomi/guest"
 	"github.com/vmware/govmomi/object"
-	"github.com/vmware/govmomi/property"
 	//"github.com/vmware/govmomi/vim25"
 	"github.com/Masterminds/glide/msg"
 	"github.com/vmware/govmomi/vim25/mo"
@@ -24,150 +17,152 @@ import (
 	"golang.org/x/net/context"
 )
 
-// addHardDisk adds a new Hard Disk to the VirtualMachine.
-func addHardDisk(vm *object.VirtualMachine, size, iops int64, diskType string, datastore *object.Datastore) error {
-	devices, err := vm.Device(context.TODO())
+// addHardDisk adds the new Hard Disk hd to the VirtualMachine.
+func addHardDisk(ctx context.Context, vm *object.VirtualMachine, hd hardDisk, datastore *object.Datastore) error {
+	devices, err := deviceList(ctx, vm)
 	if err != nil {
 		return err
 	}
 	//log.Printf("[DEBUG] vm devices: %#v\n", devices)
 
-	controller, err := devices.FindDiskController("scsi")
+	controller, devices, err := diskController(ctx, vm, devices, hd.controller, hd.unitNumber)
 	if err != nil {
 		return err
 	}
 	//log.Printf("[DEBUG] disk controller: %#v\n", controller)
 
 	disk := devices.CreateDisk(controller, datastore.Reference(), "")
-	existing := devices.SelectByBackingInfo(disk.Backing)
+	if err := setUnitNumber(devices, controller, disk, hd.unitNumber); err != nil {
+		return err
+	}
 	//log.Printf("[DEBUG] disk: %#v\n", disk)
 
-	if len(existing) == 0 {
-		disk.CapacityInKB = int64(size * 1024 * 1024)
-		if iops != 0 {
-			disk.StorageIOAllocation = &types.StorageIOAllocationInfo{
-				Limit: iops,
-			}
-		}
-		backing := disk.Backing.(*types.VirtualDiskFlatVer2BackingInfo)
-
-		if diskType == "eager_zeroed" {
-			// eager zeroed thick virtual disk
-			backing.ThinProvisioned = types.NewBool(false)
-			backing.EagerlyScrub = types.NewBool(true)
-		} else if diskType == "thin" {
-			// thin provisioned virtual disk
-			backing.ThinProvisioned = types.NewBool(true)
+	disk.CapacityInKB = int64(hd.size * 1024 * 1024)
+	if hd.iops != 0 {
+		disk.StorageIOAllocation = &types.StorageIOAllocationInfo{
+			Limit: hd.iops,
 		}
+	}
+	backing := disk.Backing.(*types.VirtualDiskFlatVer2BackingInfo)
+	backing.DiskMode = orDefault(hd.diskMode, string(types.VirtualDiskModePersistent))
+
+	switch hd.initType {
+	case initEagerZeroed:
+		// eager zeroed thick virtual disk
+		backing.ThinProvisioned = types.NewBool(false)
+		backing.EagerlyScrub = types.NewBool(true)
+	case initThick:
+		// lazy zeroed thick virtual disk
+		backing.ThinProvisioned = types.NewBool(false)
+	case initThin:
+		// thin provisioned virtual disk
+		backing.ThinProvisioned = types.NewBool(true)
+	}
 
-		//log.Printf("[DEBUG] addHardDisk: %#v\n", disk)
-		//log.Printf("[DEBUG] addHardDisk: %#v\n", disk.CapacityInKB)
+	//log.Printf("[DEBUG] addHardDisk: %#v\n", disk)
+	//log.Printf("[DEBUG] addHardDisk: %#v\n", disk.CapacityInKB)
 
-		return vm.AddDevice(context.TODO(), disk)
-	} else {
-		//log.Printf("[DEBUG] addHardDisk: Disk already present.\n")
-
-		return nil
-	}
+	return changeDevices(ctx, vm, types.VirtualDeviceConfigSpecOperationAdd, disk)
 }
 
 // buildNetworkDevice builds VirtualDeviceConfigSpec for Network Device.
-func buildNetworkDevice(f *find.Finder, label, adapterType string) (*types.VirtualDeviceConfigSpec, error) {
-	//network, err := f.Network(context.TODO(), "*"+label)
-	network, err := f.DefaultNetwork(context.TODO())
+// key is the temporary negative device key of the add.
+func buildNetworkDevice(ctx context.Context, dc *object.Datacenter, nic networkInterface, key int) (*types.VirtualDeviceConfigSpec, error) {
+	card, err := newEthernetCard(nic.adapterType)
 	if err != nil {
 		return nil, err
 	}
-
-	backing, err := network.EthernetCardBackingInfo(context.TODO())
-	if err != nil {
+	card.GetVirtualEthernetCard().Key = key
+	if err := configureEthernetCard(ctx, dc, nic, card); err != nil {
 		return nil, err
 	}
 
-	// add virtualdeviceconnectinfo
-	//for _, customnetwork := range network {
-	//	fmt.Println(customnetwork.GetVirtualDevice())
-	//}
-
-	// make default adapterType
-	if adapterType == "" {
-		adapterType = "vmxnet3"
-	}
-
-	if adapterType == "vmxnet3" {
-		return &types.VirtualDeviceConfigSpec{
-			Operation: types.VirtualDeviceConfigSpecOperationAdd,
-			Device: &types.VirtualVmxnet3{
-				VirtualVmxnet: types.VirtualVmxnet{
-					VirtualEthernetCard: types.VirtualEthernetCard{
-						VirtualDevice: types.VirtualDevice{
-							Key:     -1,
-							Backing: backing,
-						},
-						AddressType: string(types.VirtualEthernetCardMacTypeGenerated),
-					},
-				},
-			},
-		}, nil
-	} else if adapterType == "e1000" {
-		return &types.VirtualDeviceConfigSpec{
-			Operation: types.VirtualDeviceConfigSpecOperationAdd,
-			Device: &types.VirtualE1000{
-				VirtualEthernetCard: types.VirtualEthernetCard{
-					VirtualDevice: types.VirtualDevice{
-						Key:     -1,
-						Backing: backing,
-					},
-					AddressType: string(types.VirtualEthernetCardMacTypeGenerated),
-				},
-			},
-		}, nil
-	} else {
-		return nil, fmt.Errorf("Invalid network adapter type.")
-	}
+	return &types.VirtualDeviceConfigSpec{
+		Operation: types.VirtualDeviceConfigSpecOperationAdd,
+		Device:    card.(types.BaseVirtualDevice),
+	}, nil
 }
 
 // buildVMRelocateSpec builds VirtualMachineRelocateSpec to set a place for a new VirtualMachine.
-func buildVMRelocateSpec(rp *object.ResourcePool, ds *object.Datastore, host *object.HostSystem, vm *object.VirtualMachine, initType string) (types.VirtualMachineRelocateSpec, error) {
-	var key int
-
-	devices, err := vm.Device(context.TODO())
+// A nil host leaves the choice to drs.
+// Every template disk gets its own locator from the hardDisks entry at its
+// position: the datastore and the provisioning of the copy. A linked clone
+// makes every disk a child of the template snapshot.
+func buildVMRelocateSpec(ctx context.Context, finder *find.Finder, rp *object.ResourcePool, ds *object.Datastore, host *object.HostSystem, vm *object.VirtualMachine, hardDisks []hardDisk, linked bool) (types.VirtualMachineRelocateSpec, error) {
+	devices, err := deviceList(ctx, vm)
 	if err != nil {
 		return types.VirtualMachineRelocateSpec{}, err
 	}
-	for _, d := range devices {
-		if devices.Type(d) == "disk" {
-			key = d.GetVirtualDevice().Key
-		}
-	}
 
-	isThin := initType == "thin"
 	rpr := rp.Reference()
 	dsr := ds.Reference()
-	hst := host.Reference()
-	// TODO : add host
-	return types.VirtualMachineRelocateSpec{
+	spec := types.VirtualMachineRelocateSpec{
 		Datastore: &dsr,
 		Pool:      &rpr,
-		Disk: []types.VirtualMachineRelocateSpecDiskLocator{
-			types.VirtualMachineRelocateSpecDiskLocator{
-				Datastore: dsr,
-				DiskBackingInfo: &types.VirtualDiskFlatVer2BackingInfo{
-					DiskMode:        "persistent",
-					ThinProvisioned: types.NewBool(isThin),
-					EagerlyScrub:    types.NewBool(!isThin),
-				},
-				DiskId: key,
-			},
-		},
-		Host: &hst,
-	}, nil
+	}
+	if host != nil {
+		hst := host.Reference()
+		spec.Host = &hst
+	}
+	if linked {
+		spec.DiskMoveType = string(types.VirtualMachineRelocateDiskMoveOptionsCreateNewChildDiskBacking)
+	}
+
+	for i, d := range devices.SelectByType((*types.VirtualDisk)(nil)) {
+		var hd hardDisk
+		if i < len(hardDisks) {
+			hd = hardDisks[i]
+		}
+		if linked {
+			hd.initType = initLinked
+		}
+		locator := types.VirtualMachineRelocateSpecDiskLocator{
+			DiskId:    d.GetVirtualDevice().Key,
+			Datastore: dsr,
+		}
+		if hd.datastore != "" {
+			diskDS, err := finder.Datastore(ctx, hd.datastore)
+			if err != nil {
+				return spec, fmt.Errorf("hardDisks[%d]: %s", i, err)
+			}
+			locator.Datastore = diskDS.Reference()
+		}
+
+		backing := &types.VirtualDiskFlatVer2BackingInfo{
+			DiskMode: orDefault(hd.diskMode, string(types.VirtualDiskModePersistent)),
+		}
+		switch hd.initType {
+		case initLinked:
+			// a delta disk on top of the template snapshot, the format
+			// is the one of the parent
+			locator.DiskMoveType = string(types.VirtualMachineRelocateDiskMoveOptionsCreateNewChildDiskBacking)
+			backing = nil
+		case initThin:
+			backing.ThinProvisioned = types.NewBool(true)
+		case initThick:
+			backing.ThinProvisioned = types.NewBool(false)
+			backing.EagerlyScrub = types.NewBool(false)
+		case initEagerZeroed:
+			backing.ThinProvisioned = types.NewBool(false)
+			backing.EagerlyScrub = types.NewBool(true)
+		default:
+			// same format as the template disk
+			if hd.diskMode == "" {
+				backing = nil
+			}
+		}
+		if backing != nil {
+			locator.DiskBackingInfo = backing
+		}
+		spec.Disk = append(spec.Disk, locator)
+	}
+	return spec, nil
 }
 
 // getDatastoreObject gets datastore object.
-func getDatastoreObject(client *govmomi.Client, f *object.DatacenterFolders, name string) (types.ManagedObjectReference, error) {
+func getDatastoreObject(ctx context.Context, client *govmomi.Client, f *object.DatacenterFolders, name string) (types.ManagedObjectReference, error) {
 	s := object.NewSearchIndex(client.Client)
-	ref, err := s.FindChild(context.TODO(), f.DatastoreFolder, name)
+	ref, err := s.FindChild(ctx, f.DatastoreFolder, name)
 	if err != nil {
 		return types.ManagedObjectReference{}, err
 	}
@@ -178,19 +173,6 @@ func getDatastoreObject(client *govmomi.Client, f *object.DatacenterFolders, nam
 	return ref.Reference(), nil
 }
 
-// getVmGuestInfo get guest information.
-func getVmGuestInfo(client *govmomi.Client, vm types.ManagedObjectReference) (types.GuestInfo, error) {
-
-	var mvm mo.VirtualMachine
-
-	collector := property.DefaultCollector(client.Client)
-	if err := collector.RetrieveOne(context.TODO(), vm, []string{"guest"}, &mvm); err != nil {
-		return types.GuestInfo{}, err
-	}
-
-	return *mvm.Guest, nil
-}
-
 // buildStoragePlacementSpecCreate builds StoragePlacementSpec for create action.
 func buildStoragePlacementSpecCreate(f *object.DatacenterFolders, rp *object.ResourcePool, storagePod object.StoragePod, configSpec types.VirtualMachineConfigSpec) types.StoragePlacementSpec {
 	vmfr := f.VmFolder.Reference()
@@ -211,23 +193,26 @@ func buildStoragePlacementSpecCreate(f *object.DatacenterFolders, rp *object.Res
 }
 
 // buildStoragePlacementSpecClone builds StoragePlacementSpec for clone action.
-func buildStoragePlacementSpecClone(c *govmomi.Client, f *object.DatacenterFolders, vm *object.VirtualMachine, rp *object.ResourcePool, storagePod object.StoragePod) types.StoragePlacementSpec {
+func buildStoragePlacementSpecClone(ctx context.Context, c *govmomi.Client, f *object.DatacenterFolders, vm *object.VirtualMachine, rp *object.ResourcePool, storagePod object.StoragePod) (types.StoragePlacementSpec, error) {
 	vmr := vm.Reference()
 	vmfr := f.VmFolder.Reference()
 	rpr := rp.Reference()
 	spr := storagePod.Reference()
 
 	var o mo.VirtualMachine
-	err := vm.Properties(context.TODO(), vmr, []string{"datastore"}, &o)
+	err := vm.Properties(ctx, vmr, []string{"datastore"}, &o)
 	if err != nil {
-		return types.StoragePlacementSpec{}
+		return types.StoragePlacementSpec{}, err
+	}
+	if len(o.Datastore) == 0 {
+		return types.StoragePlacementSpec{}, fmt.Errorf("template %s is on no datastore", vm.InventoryPath)
 	}
 	ds := object.NewDatastore(c.Client, o.Datastore[0])
 	//log.Printf("[DEBUG] findDatastore: datastore: %#v\n", ds)
 
-	devices, err := vm.Device(context.TODO())
+	devices, err := deviceList(ctx, vm)
 	if err != nil {
-		return types.StoragePlacementSpec{}
+		return types.StoragePlacementSpec{}, err
 	}
 
 	var key int
@@ -259,209 +244,312 @@ func buildStoragePlacementSpecClone(c *govmomi.Client, f *object.DatacenterFolde
 		CloneName: "dummy",
 		Folder:    &vmfr,
 	}
-	return sps
+	return sps, nil
 }
 
 // findDatastore finds Datastore object.
-func findDatastore(c *govmomi.Client, sps types.StoragePlacementSpec) (*object.Datastore, error) {
+func findDatastore(ctx context.Context, c *govmomi.Client, sps types.StoragePlacementSpec) (*object.Datastore, error) {
 	var datastore *object.Datastore
 	//log.Printf("[DEBUG] findDatastore: StoragePlacementSpec: %#v\n", sps)
 
 	srm := object.NewStorageResourceManager(c.Client)
-	rds, err := srm.RecommendDatastores(context.TODO(), sps)
+	rds, err := srm.RecommendDatastores(ctx, sps)
 	if err != nil {
 		return nil, err
 	}
 	//log.Printf("[DEBUG] findDatastore: recommendDatastores: %#v\n", rds)
 
-	spa := rds.Recommendations[0].Action[0].(*types.StoragePlacementAction)
+	if len(rds.Recommendations) == 0 || len(rds.Recommendations[0].Action) == 0 {
+		return nil, newError(ErrPlacement, "", "recommend datastore", fmt.Errorf("storage drs recommends no datastore"))
+	}
+	spa, ok := rds.Recommendations[0].Action[0].(*types.StoragePlacementAction)
+	if !ok {
+		return nil, newError(ErrPlacement, "", "recommend datastore", fmt.Errorf("storage drs recommends %T instead of a datastore", rds.Recommendations[0].Action[0]))
+	}
 	datastore = object.NewDatastore(c.Client, spa.Destination)
 	//log.Printf("[DEBUG] findDatastore: datastore: %#v", datastore)
 
 	return datastore, nil
 }
 
-// deployVirtualMachine deploys a new VirtualMachine.
-func (vm *virtualMachine) deployVirtualMachine(c *govmomi.Client) *object.VirtualMachine {
-	dc, err := getDatacenter(c, vm.datacenter)
-	if err != nil {
-		fmt.Println(err.Error())
+// placement holds the inventory objects and specs a clone of vm needs.
+type placement struct {
+	dc             *object.Datacenter
+	finder         *find.Finder
+	template       *object.VirtualMachine
+	resourcePool   *object.ResourcePool
+	host           *object.HostSystem // nil when drs places the vm
+	hostName       string
+	drs            string // the cluster placing the vm
+	placedMB       int64  // memory counted on host, see placedMemory
+	folder         *object.Folder
+	datastore      *object.Datastore
+	relocateSpec   types.VirtualMachineRelocateSpec
+	snapshot       *types.ManagedObjectReference // base of linked disks
+	createSnapshot bool                          // the named snapshot does not exist yet
+	fallback       string                        // why an instant clone is made linked
+	networkDevices []types.BaseVirtualDeviceConfigSpec
+	nics           []types.BaseVirtualDevice
+	customSpec     *types.CustomizationSpec
+	guestID        string
+}
+
+// resolve looks up every inventory object the clone of vm needs. It
+// changes nothing in vCenter, so it doubles as the dry run. It returns the
+// first error of resolveAll.
+func (vm *virtualMachine) resolve(ctx context.Context, c *govmomi.Client, placed *placedMemory) (*placement, error) {
+	p, errs := vm.resolveAll(ctx, c, placed)
+	if len(errs) > 0 {
+		return nil, errs[0]
 	}
-	g.Check(err != nil, "getDatacenter error", err)
-	if !g.Gret {
-		g.GoBack()
-		return nil
+	return p, nil
+}
+
+// resolveAll is resolve that goes on past a failed lookup with every
+// stage that does not depend on it, and returns all the errors. The
+// placement is only complete without errors, and counts no memory in
+// placed then.
+func (vm *virtualMachine) resolveAll(ctx context.Context, c *govmomi.Client, placed *placedMemory) (*placement, []error) {
+	var errs []error
+	fail := func(kind ErrorKind, op string, err error) {
+		errs = append(errs, newError(kind, vm.name, op, err))
+	}
+
+	dc, err := getDatacenter(ctx, c, vm.datacenter)
+	if err != nil {
+		fail(ErrUnknown, "get datacenter", err)
+		return nil, errs
 	}
 	finder := find.NewFinder(c.Client, true)
 	finder = finder.SetDatacenter(dc)
+	p := &placement{dc: dc, finder: finder}
+
+	dcFolders, err := dc.Folders(ctx)
+	if err != nil {
+		fail(ErrUnknown, "get datacenter folders", err)
+		return p, errs
+	}
 
-	template, err := finder.VirtualMachine(context.TODO(), vm.template)
-	g.Check(err != nil, "get vm template error", err)
-	if !g.Gret {
-		g.GoBack()
-		return nil
+	template, err := finder.VirtualMachine(ctx, vm.template)
+	if err != nil {
+		fail(ErrUnknown, "get template", err)
 	}
 	//log.Printf("[DEBUG] template: %#v", template)
 
 	var resourcePool *object.ResourcePool
 	if vm.resourcePool == "" {
 		if vm.cluster == "" {
-			resourcePool, err = finder.DefaultResourcePool(context.TODO())
-			g.Check(err != nil, "get resourcePool error", err)
-			if !g.Gret {
-				g.GoBack()
-				return nil
-			}
+			resourcePool, err = finder.DefaultResourcePool(ctx)
 		} else {
-			resourcePool, err = finder.ResourcePool(context.TODO(), "*"+vm.cluster+"/Resources")
-			g.Check(err != nil, "get resourcePool error", err)
-			if !g.Gret {
-				g.GoBack()
-				return nil
-			}
+			resourcePool, err = finder.ResourcePool(ctx, "*"+vm.cluster+"/Resources")
 		}
 	} else {
-		resourcePool, err = finder.ResourcePool(context.TODO(), vm.resourcePool)
-		g.Check(err != nil, "get resourcePool error", err)
-		if !g.Gret {
-			g.GoBack()
-			return nil
-		}
-	}
-	//log.Printf("[DEBUG] resource pool: %#v", resourcePool)
-
-	dcFolders, err := dc.Folders(context.TODO())
-	g.Check(err != nil, "get dcFolder error", err)
-	if !g.Gret {
-		g.GoBack()
-		return nil
+		resourcePool, err = finder.ResourcePool(ctx, vm.resourcePool)
 	}
-
-	// get cluster name for getting host based on template
-	cluster := strings.Split(resourcePool.InventoryPath, "/")[3]
-	hostObj, err := finder.HostSystem(context.TODO(), dcFolders.HostFolder.InventoryPath+"/"+cluster+"/"+vm.host)
-	g.Check(err != nil, "get host object error", err)
-	if !g.Gret {
-		g.GoBack()
-		return nil
+	if err != nil {
+		fail(ErrUnknown, "get resource pool", err)
 	}
-	//return nil
+	//log.Printf("[DEBUG] resource pool: %#v", resourcePool)
 
 	//log.Printf("[DEBUG] folder: %#v", vm.folder)
 	folder := dcFolders.VmFolder
 	if len(vm.folder) > 0 {
+		// relative to the vm folder of the datacenter resolved above,
+		// which may be the default one
 		si := object.NewSearchIndex(c.Client)
 		folderRef, err := si.FindByInventoryPath(
-			context.TODO(), fmt.Sprintf("%v/vm/%v", vm.datacenter, vm.folder))
+			ctx, dcFolders.VmFolder.InventoryPath+"/"+strings.Trim(vm.folder, "/"))
 		if err != nil {
-			//return fmt.Errorf("Error reading folder %s: %s", vm.folder, err)
-			fmt.Errorf("Error reading folder %s: %s", vm.folder, err)
+			fail(ErrUnknown, "get folder", err)
+		} else if f, ok := folderRef.(*object.Folder); ok {
+			folder = f
 		} else if folderRef == nil {
-			//return fmt.Errorf("Cannot find folder %s", vm.folder)
-			fmt.Errorf("Cannot find folder %s", vm.folder)
+			fail(ErrNotFound, "get folder", fmt.Errorf("Cannot find folder %s in %s", vm.folder, dcFolders.VmFolder.InventoryPath))
 		} else {
-			folder = folderRef.(*object.Folder)
+			fail(ErrInvalidSpec, "get folder", fmt.Errorf("%s is a %s, not a folder", vm.folder, folderRef.Reference().Type))
 		}
 	}
 
 	var datastore *object.Datastore
 	if vm.datastore == "" {
 		// do not use the default datastore
-		//datastore, err = finder.DefaultDatastore(context.TODO())
-		g.Check(vm.datastore == "", " No vm datastore declare, please init vm.datastor", nil)
-		if !g.Gret {
-			g.GoBack()
-			return nil
-		}
+		//datastore, err = finder.DefaultDatastore(ctx)
+		fail(ErrInvalidSpec, "get datastore", fmt.Errorf("No vm datastore declared"))
 	} else {
-		datastore, err = finder.Datastore(context.TODO(), vm.datastore)
+		datastore, err = finder.Datastore(ctx, vm.datastore)
 		if err != nil {
 			// TODO: datastore cluster support in govmomi finder function
-			d, err := getDatastoreObject(c, dcFolders, vm.datastore)
-			g.Check(err != nil, "498 : get datastore object error", err)
-			if !g.Gret {
-				g.GoBack()
-				return nil
-			}
-
-			if d.Type == "StoragePod" {
+			d, err := getDatastoreObject(ctx, c, dcFolders, vm.datastore)
+			switch {
+			case err != nil:
+				fail(ErrUnknown, "get datastore", err)
+			case d.Type != "StoragePod":
+				datastore = object.NewDatastore(c.Client, d)
+			case template != nil && resourcePool != nil:
 				sp := object.StoragePod{
 					Folder: object.NewFolder(c.Client, d),
 				}
-				sps := buildStoragePlacementSpecClone(c, dcFolders, template, resourcePool, sp)
-
-				datastore, err = findDatastore(c, sps)
-				g.Check(err != nil, "507 : find datastore error", err)
-				if !g.Gret {
-					g.GoBack()
-					return nil
+				sps, err := buildStoragePlacementSpecClone(ctx, c, dcFolders, template, resourcePool, sp)
+				if err == nil {
+					datastore, err = findDatastore(ctx, c, sps)
+				}
+				if err != nil {
+					fail(ErrUnknown, "recommend datastore", err)
 				}
-			} else {
-				datastore = object.NewDatastore(c.Client, d)
 			}
 		}
 	}
-
 	//log.Printf("[DEBUG] datastore: %#v", datastore)
 
-	relocateSpec, err := buildVMRelocateSpec(resourcePool, datastore, hostObj, template, vm.hardDisks[0].initType)
-	g.Check(err != nil, "517 : buildVMRelocateSpec error", err)
-	if !g.Gret {
-		g.GoBack()
-		return nil
-	}
-
-	//log.Printf("[DEBUG] relocate spec: %v", relocateSpec)
-
-	// network
-	networkDevices := []types.BaseVirtualDeviceConfigSpec{}
-	networkConfigs := []types.CustomizationAdapterMapping{}
-	for _, network := range vm.networkInterfaces {
-		// network device
-		nd, err := buildNetworkDevice(finder, network.label, "vmxnet3")
-		g.Check(err != nil, "527 : buildNetworkDevice error", err)
-		if !g.Gret {
-			g.GoBack()
-			return nil
-		}
-		networkDevices = append(networkDevices, nd)
-
-		// TODO: IPv6 support
-		var ipSetting types.CustomizationIPSettings
-		if network.ipv4Address == "" {
-			ipSetting = types.CustomizationIPSettings{
-				Ip: &types.CustomizationDhcpIpGenerator{},
+	// the named host, or one picked by drs or by load
+	hosts := &hostPlacement{}
+	if resourcePool != nil && datastore != nil && (template != nil || !vm.hasLinkedDisks()) {
+		if hosts, err = vm.placeHost(ctx, c, resourcePool, datastore, template, placed); err != nil {
+			fail(ErrInvalidSpec, "place host", err)
+			hosts = nil
+		}
+	}
+
+	if template != nil {
+		if vm.instant {
+			p.fallback, err = vm.instantFallback(ctx, c, template)
+			if err != nil {
+				fail(ErrInvalidSpec, "check instant clone source", err)
 			}
-		} else {
-			if network.ipv4PrefixLength == 0 {
-				//return fmt.Errorf("Error: ipv4_prefix_length argument is empty.")
-				fmt.Errorf("Error: ipv4_prefix_length argument is empty.")
+		}
+
+		if resourcePool != nil && datastore != nil && hosts != nil {
+			p.relocateSpec, err = buildVMRelocateSpec(ctx, finder, resourcePool, datastore, hosts.host, template, vm.hardDisks, vm.linked || vm.instant)
+			if err != nil {
+				fail(ErrUnknown, "build relocate spec", err)
 			}
-			m := net.CIDRMask(network.ipv4PrefixLength, 32)
-			sm := net.IPv4(m[0], m[1], m[2], m[3])
-			subnetMask := sm.String()
-			//log.Printf("[DEBUG] gateway: %v", vm.gateway)
-			//log.Printf("[DEBUG] ipv4 address: %v", network.ipv4Address)
-			//log.Printf("[DEBUG] ipv4 prefix length: %v", network.ipv4PrefixLength)
-			//log.Printf("[DEBUG] ipv4 subnet mask: %v", subnetMask)
-			ipSetting = types.CustomizationIPSettings{
-				Gateway: []string{
-					vm.gateway,
-				},
-				Ip: &types.CustomizationFixedIp{
-					IpAddress: network.ipv4Address,
-				},
-				SubnetMask: subnetMask,
+		}
+
+		// linked disks and forks share the disks of the template
+		if vm.hasLinkedDisks() && hosts != nil && hosts.host != nil {
+			if err := checkLinkedDatastores(ctx, template, hosts.host); err != nil {
+				fail(ErrInvalidSpec, "check linked clone datastores", err)
+			}
+		}
+
+		//log.Printf("[DEBUG] relocate spec: %v", relocateSpec)
+
+		// network
+		templateDevices, err := deviceList(ctx, template)
+		if err != nil {
+			fail(ErrUnknown, "get template devices", err)
+		} else {
+			p.networkDevices, p.nics, err = nicDeviceChanges(ctx, dc, vm.nicPolicy, templateDevices, vm.networkInterfaces)
+			if err != nil {
+				fail(ErrUnknown, "build network devices", err)
 			}
 		}
 
-		// network config
-		config := types.CustomizationAdapterMapping{
-			Adapter: ipSetting,
+		// the configured guest os: the tools of a powered off template
+		// may never have reported one
+		p.guestID, err = configGuestID(ctx, template)
+		switch {
+		case err != nil:
+			fail(ErrUnknown, "get template guest id", err)
+		case p.guestID == "":
+			fail(ErrInvalidSpec, "get template guest id", fmt.Errorf("template %s has no guest os set, the guest customization needs one", vm.template))
+		}
+	}
+
+	if vm.instant && p.fallback == "" {
+		p.fallback = vm.instantUnsupported(p)
+	}
+
+	// linked disks are children of a template snapshot
+	if template != nil && vm.needsSnapshot(p) {
+		p.snapshot, p.createSnapshot, err = vm.linkedSnapshot(ctx, template)
+		if err != nil {
+			fail(ErrInvalidSpec, "get template snapshot", err)
+		}
+	}
+
+	// the nic count of keep and edit comes from the template
+	nicCount := len(vm.networkInterfaces)
+	if p.nics != nil {
+		nicCount = len(p.nics)
+	}
+	if vm.specName() != "" {
+		p.customSpec, err = vm.namedCustomizationSpec(ctx, c, nicCount)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	} else if p.guestID != "" {
+		p.customSpec, err = vm.customizationSpec(p.guestID, nicCount)
+		if err != nil {
+			fail(ErrInvalidSpec, "build customization spec", err)
+		}
+	}
+
+	p.template = template
+	p.resourcePool = resourcePool
+	p.folder = folder
+	p.datastore = datastore
+	if hosts != nil {
+		p.host, p.hostName, p.drs, p.placedMB = hosts.host, hosts.name, hosts.drs, hosts.placedMB
+	}
+	if len(errs) > 0 {
+		placed.release(p)
+	}
+	return p, errs
+}
+
+// claimPlacement logs where vm goes and, when it was placed on a host by
+// load, waits with claimHost for the per host cap.
+func (vm *virtualMachine) claimPlacement(ctx context.Context, p *placement, claimHost claimHostFunc) error {
+	switch {
+	case p.drs != "":
+		msg.Info("vm %s: drs of %s places the vm", vm.name, p.drs)
+	case vm.host == "":
+		msg.Info("vm %s: placed on host %s", vm.name, p.hostName)
+		if err := claimHost(ctx, p.hostName); err != nil {
+			return newError(ErrUnknown, vm.name, "wait for host "+p.hostName, err)
+		}
+	}
+	return nil
+}
+
+// deployVirtualMachine deploys a new VirtualMachine at p and reports
+// whether it is an instant clone, running already. Once the clone task
+// succeeded the new vm is returned even when a later step fails.
+func (vm *virtualMachine) deployVirtualMachine(ctx context.Context, c *govmomi.Client, p *placement) (*object.VirtualMachine, bool, error) {
+	var err error
+	finder, template, networkDevices := p.finder, p.template, p.networkDevices
+
+	if vm.instant && p.fallback == "" {
+		msg.Info("vm %s: instant clone of %s", vm.name, vm.template)
+		task, err := vm.deployInstant(ctx, c, p)
+		var info *types.TaskInfo
+		if err == nil {
+			info, err = waitTask(ctx, task)
+		}
+		switch {
+		case err == nil:
+			newVM, err := vm.clonedVM(ctx, c, finder, info)
+			return newVM, true, err
+		case !isNotSupported(err):
+			return nil, false, newError(ErrUnknown, vm.name, "instant clone", err)
+		}
+		p.fallback = err.Error()
+		// the fork needed no snapshot, the linked clone does
+		if p.snapshot == nil && !p.createSnapshot {
+			if p.snapshot, p.createSnapshot, err = vm.linkedSnapshot(ctx, template); err != nil {
+				return nil, false, newError(ErrInvalidSpec, vm.name, "get template snapshot", fmt.Errorf("vCenter refused the instant clone (%s) and the linked clone instead needs a snapshot: %s", p.fallback, err))
+			}
+		}
+	}
+	if p.fallback != "" {
+		msg.Warn("vm %s: linked clone instead of instant clone, %s", vm.name, p.fallback)
+	}
+	if p.createSnapshot {
+		if p.snapshot, err = vm.createLinkedSnapshot(ctx, template); err != nil {
+			return nil, false, newError(ErrUnknown, vm.name, "create template snapshot", err)
 		}
-		networkConfigs = append(networkConfigs, config)
 	}
-	//log.Printf("[DEBUG] network configs: %v", networkConfigs[0].Adapter)
 
 	// make config spec
 	configSpec := types.VirtualMachineConfigSpec{
@@ -470,6 +558,12 @@ func (vm *virtualMachine) deployVirtualMachine(c *govmomi.Client) *object.Virtua
 		MemoryMB:          vm.memoryMb,
 		DeviceChange:      networkDevices,
 	}
+	for _, n := range vm.networkInterfaces {
+		if n.adapterType == "sriov" {
+			// SR-IOV passthrough needs all guest memory reserved
+			configSpec.MemoryReservationLockedToMax = types.NewBool(true)
+		}
+	}
 	//log.Printf("[DEBUG] virtual machine config spec: %v", configSpec)
 
 	//log.Printf("[DEBUG] starting extra custom config spec: %v", vm.customConfigurations)
@@ -478,11 +572,9 @@ func (vm *virtualMachine) deployVirtualMachine(c *govmomi.Client) *object.Virtua
 	if len(vm.customConfigurations) > 0 {
 		var ov []types.BaseOptionValue
 		for k, v := range vm.customConfigurations {
-			key := k
-			value := v
 			o := types.OptionValue{
-				Key:   key,
-				Value: &value,
+				Key:   k,
+				Value: v,
 			}
 			ov = append(ov, &o)
 		}
@@ -490,129 +582,77 @@ func (vm *virtualMachine) deployVirtualMachine(c *govmomi.Client) *object.Virtua
 		//log.Printf("[DEBUG] virtual machine Extra Config spec: %v", configSpec.ExtraConfig)
 	}
 
-	// create CustomizationSpec
-	//customSpec := types.CustomizationSpec{
-	//	Identity: &types.CustomizationLinuxPrep{
-	//		HostName: &types.CustomizationFixedName{
-	//			Name: strings.Split(vm.name, ".")[0],
-	//		},
-	//		Domain:     vm.domain,
-	//		TimeZone:   vm.timeZone,
-	//		HwClockUTC: types.NewBool(true),
-	//	},
-	//	GlobalIPSettings: types.CustomizationGlobalIPSettings{
-	//		DnsSuffixList: vm.dnsSuffixes,
-	//		DnsServerList: vm.dnsServers,
-	//	},
-	//	//NicSettingMap: []types.CustomizationAdapterMapping{},
-	//	NicSettingMap: networkConfigs,
-	//}
-
-	// get the guest info
-	guestInfo, err := getVmGuestInfo(c, template.Reference())
-	g.Check(err != nil, "615 : getVmGuestInfo error", err)
-	if !g.Gret {
-		g.GoBack()
-		return nil
-	}
-
-	// check for windows guest
-	windowsGuest, err := regexp.MatchString("windows", guestInfo.GuestId)
-	//log.Printf("[DEBUG] guestId: %v", guestInfo.GuestId)
-
-	if windowsGuest {
-		log.Printf("[DEBUG] isWindows")
-	}
-
-	/*
-		if vm.customizationSpecification != nil {
-
-			if v, ok := vm.customizationSpecification["name"]; ok {
-				specManager := object.NewCustomizationSpecManager(c.Client)
-				specItem, err := specManager.GetCustomizationSpec(context.TODO(), v.(string))
-				g.Check(err != nil, "630 : specManager.GetCustomizationSpec error", err)
-				customSpec = specItem.Spec
-			}
-
-		}
-	*/
-
 	//log.Printf("[DEBUG] custom spec: %v", customSpec)
 
 	// make vm clone spec
 	cloneSpec := types.VirtualMachineCloneSpec{
-		Location: relocateSpec,
+		Location: p.relocateSpec,
+		Snapshot: p.snapshot,
 		Template: false,
 		Config:   &configSpec,
 		PowerOn:  false,
+		// applied by the guest on its first boot
+		Customization: p.customSpec,
 	}
 	//log.Printf("[DEBUG] clone spec: %v", cloneSpec)
 
-	task, err := template.Clone(context.TODO(), folder, vm.name, cloneSpec)
-	g.Check(err != nil, "648 : template clone error", err)
-	if !g.Gret {
-		g.GoBack()
-		return nil
-	}
-
-	_, err = task.WaitForResult(context.TODO(), nil)
-	g.Check(err != nil, "651 : clone task error", err)
-	if !g.Gret {
-		g.GoBack()
-		return nil
+	task, err := template.Clone(ctx, p.folder, vm.name, cloneSpec)
+	if err != nil {
+		return nil, false, newError(ErrUnknown, vm.name, "clone", err)
 	}
 
-	newVM, err := finder.VirtualMachine(context.TODO(), vm.Path())
-	g.Check(err != nil, "657 : find virtual machine error", err)
-	if !g.Gret {
-		g.GoBack()
-		return nil
+	info, err := waitTask(ctx, task)
+	if err != nil {
+		return nil, false, newError(ErrUnknown, vm.name, "clone", err)
 	}
-	//log.Printf("[DEBUG] new vm: %v", newVM)
+	newVM, err := vm.clonedVM(ctx, c, finder, info)
+	return newVM, false, err
+}
 
-	devices, err := newVM.Device(context.TODO())
-	g.Check(err != nil, "658 : new vm device can not be found", err)
-	if !g.Gret {
-		g.GoBack()
-		return nil
-	}
-
-	for _, dvc := range devices {
-		// Issue 3559/3560: Delete all ethernet devices to add the correct ones later
-		if devices.Type(dvc) == "ethernet" {
-			err := newVM.RemoveDevice(context.TODO(), dvc)
-			g.Check(err != nil, "664 : new vm remove device error", err)
-			if !g.Gret {
-				g.GoBack()
-				return nil
-			}
+// clonedVM returns the vm created by the clone task of info. From there on
+// the vm exists, so it is returned with any error for the caller to roll
+// back.
+func (vm *virtualMachine) clonedVM(ctx context.Context, c *govmomi.Client, finder *find.Finder, info *types.TaskInfo) (*object.VirtualMachine, error) {
+	ref, ok := info.Result.(types.ManagedObjectReference)
+	if !ok {
+		// the vm is only found by its path then
+		newVM, err := finder.VirtualMachine(ctx, vm.Path())
+		if err != nil {
+			return nil, newError(ErrTaskFault, vm.name, "clone", fmt.Errorf("clone task returned %T instead of the new vm", info.Result))
 		}
+		return newVM, nil
 	}
-	// Add Network devices
-	for _, dvc := range networkDevices {
-		err := newVM.AddDevice(
-			context.TODO(), dvc.GetVirtualDeviceConfigSpec().Device)
-		g.Check(err != nil, "671 : new vm add device error", err)
-		if !g.Gret {
-			g.GoBack()
-			return nil
-		}
+	created := object.NewVirtualMachine(c.Client, ref)
+
+	newVM, err := finder.VirtualMachine(ctx, vm.Path())
+	if err != nil {
+		return created, newError(ErrUnknown, vm.name, "find new vm", err)
 	}
+	//log.Printf("[DEBUG] new vm: %v", newVM)
 
-	// power on the newVM
-	newVM.PowerOn(context.TODO())
+	return newVM, nil
+}
 
-	return newVM
+// powerOnVM powers on the new vm and waits for the task.
+func (vm *virtualMachine) powerOnVM(ctx context.Context, newVM *object.VirtualMachine) error {
+	task, err := newVM.PowerOn(ctx)
+	if err == nil {
+		_, err = waitTask(ctx, task)
+	}
+	if err == nil {
+		err = newVM.WaitForPowerState(ctx, types.VirtualMachinePowerStatePoweredOn)
+	}
+	return err
 }
 
 // getDatacenter gets datacenter object
-func getDatacenter(c *govmomi.Client, dc string) (*object.Datacenter, error) {
+func getDatacenter(ctx context.Context, c *govmomi.Client, dc string) (*object.Datacenter, error) {
 	finder := find.NewFinder(c.Client, true)
 	if dc != "" {
-		d, err := finder.Datacenter(context.TODO(), dc)
+		d, err := finder.Datacenter(ctx, dc)
 		return d, err
 	} else {
-		d, err := finder.DefaultDatacenter(context.TODO())
+		d, err := finder.DefaultDatacenter(ctx)
 		return d, err
 	}
 }
@@ -623,8 +663,11 @@ func (vm *virtualMachine) Path() string {
 	return vmPath(vm.folder, vm.name)
 }
 
-// get vm's IPAddress
+// get vm's IPAddress, the ipv6 one on an ipv6 only nic
 func (vm *virtualMachine) IPAddr() string {
+	if vm.networkInterfaces[0].ipv4Address == "" {
+		return vm.networkInterfaces[0].ipv6Address
+	}
 	return vm.networkInterfaces[0].ipv4Address
 }
 
@@ -673,29 +716,55 @@ func createVMObj() *virtualMachine {
 	return &oVM
 }
 
-// create object of vm
-func createVMObjs() []virtualMachine {
+// createVMObjs reads the vms of a manifest, or of a legacy vmlist with one
+// vm per line: address name host datastore template gateway. The address
+// is a /24 unless written as address/prefix; lines starting with # are
+// comments.
+func createVMObjs(vmlistPath string) ([]virtualMachine, error) {
+	if isManifest(vmlistPath) {
+		oVM, err := loadManifest(vmlistPath)
+		if err != nil {
+			return nil, newError(ErrInvalidSpec, "", "read manifest", err)
+		}
+		return oVM, nil
+	}
+
 	var oVM []virtualMachine
-	baRet, err := ioutil.ReadFile("vmlistPath")
-	g.Check(err != nil, "Read file error", err)
-	if !g.Gret {
-		g.GoBack()
-		return nil
+	baRet, err := ioutil.ReadFile(vmlistPath)
+	if err != nil {
+		return nil, newError(ErrInvalidSpec, "", "read vmlist", err)
 	}
 	vmInfos := strings.Split(string(baRet), "\n")
-	for _, info := range vmInfos {
+	for i, info := range vmInfos {
+		info = strings.TrimSpace(info)
+		if info == "" || strings.HasPrefix(info, "#") {
+			continue
+		}
 		var oNet networkInterface
 		var oNetArr []networkInterface
 		var oDiskArr []hardDisk
 		var oDisk hardDisk
-		items := strings.Split(info, " ")
-		g.Check(len(items) != 5, "config file error", nil)
-		if !g.Gret {
-			g.GoBack()
-			return nil
+		items := strings.Fields(info)
+		invalid := func(format string, a ...interface{}) error {
+			return newError(ErrInvalidSpec, "", "read vmlist",
+				fmt.Errorf("%s line %d: %s", vmlistPath, i+1, fmt.Sprintf(format, a...)))
+		}
+		switch {
+		case len(items) == 5:
+			// the guest customization rewrites the whole template network
+			return nil, invalid("no gateway, add it as the sixth column or the vm has no default route")
+		case len(items) != 6:
+			return nil, invalid("want 6 columns, got %d", len(items))
 		}
 		var vm virtualMachine
-		oNet.ipv4Address = items[0]
+		// an address without a prefix is taken as a /24
+		oNet.ipv4Address, oNet.ipv4PrefixLength, err = splitCIDR(items[0], 0)
+		if err != nil {
+			return nil, invalid("%s", err)
+		}
+		if oNet.ipv4PrefixLength == 0 {
+			oNet.ipv4PrefixLength = 24
+		}
 		oNetArr = append(oNetArr, oNet)
 		oDisk.initType = ""
 		oDiskArr = append(oDiskArr, oDisk)
@@ -705,168 +774,251 @@ func createVMObjs() []virtualMachine {
 		vm.host = items[2]
 		vm.datastore = items[3]
 		vm.template = items[4]
+		vm.gateway = items[5]
+		if errs := vm.validateNetwork(); len(errs) > 0 {
+			return nil, invalid("%s", errs[0])
+		}
 		oVM = append(oVM, vm)
 	}
-
-	return oVM
-}
-
-// clone the vm
-func deployVMs(vm *virtualMachine, client *govmomi.Client) *object.VirtualMachine {
-	vmClient := vm.deployVirtualMachine(client)
-	g.Check(vmClient == nil, "Deploy the vm error", nil)
-	if g.Gret == false {
-		g.GoBack()
-		return nil
+	if len(oVM) == 0 {
+		return nil, newError(ErrInvalidSpec, "", "read vmlist", fmt.Errorf("%s declares no vms", vmlistPath))
 	}
-	return vmClient
-}
 
-// login vm and process something
-func (vm *virtualMachine) vmProcess(client *govmomi.Client, vmpath, vmipaddr string) {
-	var auth types.NamePasswordAuthentication
-	auth.Username = "root"
-	auth.Password = "8bio8cwa"
+	return oVM, nil
+}
 
+// vmProcess waits for the customized guest to come up, and for its ip
+// when waitIP is set.
+func (vm *virtualMachine) vmProcess(ctx context.Context, client *govmomi.Client, t Timeouts, vmpath string, waitIP bool) error {
 	finder := find.NewFinder(client.Client, true)
-	vmInst, err := finder.VirtualMachine(context.TODO(), vmpath)
-	g.Check(err != nil, "find vm guest instance error", err)
-
-	o := guest.NewOperationsManager(vmInst.Client(), vmInst.Reference())
-	pro, err := o.ProcessManager(context.TODO())
-	g.Check(err != nil, "processor manager error", err)
+	vmInst, err := finder.VirtualMachine(ctx, vmpath)
+	if err != nil {
+		return newError(ErrUnknown, vm.name, "find vm", err)
+	}
 
 	// check vm power
 	msg.Info("Wait for power on")
-	powerstate, err := vmInst.PowerState(context.TODO())
-	g.Check(err != nil, "get vm guest power status failed", err)
-	count := 0
-	for {
-		if powerstate != "poweredOn" {
-			time.Sleep(time.Second)
-			powerstate, err = vmInst.PowerState(context.TODO())
-			g.Check(err != nil, "get vm guest power status failed", err)
-			count += 1
-			fmt.Print(". ")
-			if count == 10 {
-				g.Check(true, "try 10 times, exit...", nil)
-				if !g.Gret {
-					g.GoBack()
-					fmt.Println()
-					return
-				}
-			}
-		} else {
-			break
-		}
+	err = step(ctx, t.PowerOn, vm.name, "wait for power on", func(ctx context.Context) error {
+		return vmInst.WaitForPowerState(ctx, types.VirtualMachinePowerStatePoweredOn)
+	})
+	if err != nil {
+		return err
 	}
-	fmt.Println()
 
 	// check vmware tools
 	msg.Info("wait, the vmware tools not running...")
-	ret, err := vmInst.IsToolsRunning(context.TODO())
-	g.Check(err != nil, "get vmwaretool status error", err)
-	count = 0
-	for {
-		if ret != true {
-			time.Sleep(time.Second)
-			ret, err = vmInst.IsToolsRunning(context.TODO())
-			g.Check(err != nil, "get vmwaretool status error", err)
-			count += 1
-			fmt.Print(". ")
-			if count == 30 {
-				g.Check(true, "try 30 times, exit...", nil)
-				if !g.Gret {
-					g.GoBack()
-					fmt.Println()
-					return
-				}
-			}
-		} else {
-			break
-		}
+	err = step(ctx, t.Tools, vm.name, "wait for vmware tools", func(ctx context.Context) error {
+		return waitForTools(ctx, vmInst)
+	})
+	if err != nil || !waitIP {
+		return err
 	}
-	fmt.Println()
 
-	spec := types.GuestProgramSpec{
-		ProgramPath:      "/bin/sed",
-		Arguments:        "-i 's/10.10.10.10/" + vmipaddr + "/g' /etc/sysconfig/network-scripts/ifcfg-eth0",
-		WorkingDirectory: "/",
-		EnvVariables:     []string{},
-	}
-	_, err = pro.StartProgram(context.TODO(), &auth, &spec)
-	g.Check(err != nil, "Vm guest start program error", err)
-	if !g.Gret {
-		g.GoBack()
-		return
-	}
-	err = vmInst.RebootGuest(context.TODO())
-	g.Check(err != nil, "Vm guest reboot error", err)
-	if !g.Gret {
-		g.GoBack()
-		return
-	}
-	_, err = vmInst.WaitForIP(context.TODO())
-	g.Check(err != nil, "Wait for vm IP error", err)
-	if !g.Gret {
-		g.GoBack()
-		return
+	// the guest customization reboots the guest once before the ips
+	// of the spec show up
+	return step(ctx, t.IP, vm.name, "wait for ip", func(ctx context.Context) error {
+		return waitForGuestIPs(ctx, vmInst, vm.staticIPs())
+	})
+}
+
+// rollback destroys a vm created by a failed run. It does not use the run
+// context, an interrupted run has to clean up as well.
+func (vm *virtualMachine) rollback(newVM *object.VirtualMachine) error {
+	msg.Warn("rolling back vm %s", vm.name)
+	ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cancel()
+	if err := destroyVM(ctx, newVM); err != nil {
+		msg.Err("rollback of vm %s failed, remove it by hand: %s", vm.name, err)
+		return newError(ErrUnknown, vm.name, "rollback", err)
 	}
+	return nil
 }
 
 // the start of cloning vms
-func worker(vmObj *virtualMachine, client *govmomi.Client, ch chan string) {
-	succ := vmObj.IPAddr() + " succeed !"
-	failed := vmObj.IPAddr() + " failed !"
+func worker(ctx context.Context, vmObj *virtualMachine, client *govmomi.Client, auth *types.NamePasswordAuthentication, opts CloneOptions, claimHost claimHostFunc, placed *placedMemory) CloneResult {
+	t := opts.Timeouts
+	r := newCloneResult(vmObj)
+
 	// clone a vm using the template
-	oVmClient := deployVMs(vmObj, client)
-	g.Check(oVmClient == nil, "go vc client error", nil)
-	if g.Gret == false {
-		g.GoBack()
-		ch <- failed
-		return
+	var p *placement
+	var newVM *object.VirtualMachine
+	var forked bool // an instant clone, running with the guest of the source
+	err := r.phase("clone", func() error {
+		err := step(ctx, t.Clone, vmObj.name, "resolve", func(ctx context.Context) (err error) {
+			p, err = vmObj.resolve(ctx, client, placed)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		// the wait for a host slot is not part of the clone timeout
+		if err := vmObj.claimPlacement(ctx, p, claimHost); err != nil {
+			return err
+		}
+		return step(ctx, t.Clone, vmObj.name, "clone", func(ctx context.Context) (err error) {
+			newVM, forked, err = vmObj.deployVirtualMachine(ctx, client, p)
+			return err
+		})
+	})
+	// grow the template disks and add the extra ones while powered off,
+	// hot on a fork
+	if err == nil && vmObj.needsDiskChanges() {
+		err = r.phase("disks", func() error {
+			return step(ctx, t.Clone, vmObj.name, "configure disks", func(ctx context.Context) error {
+				return vmObj.configureDisks(ctx, newVM)
+			})
+		})
+	}
+	if err == nil && !forked {
+		err = r.phase("power on", func() error {
+			return step(ctx, t.PowerOn, vmObj.name, "power on", func(ctx context.Context) error {
+				return vmObj.powerOnVM(ctx, newVM)
+			})
+		})
 	}
-
 	// change vm config
-	vmObj.vmProcess(client, oVmClient.InventoryPath, vmObj.IPAddr())
-	if g.Gret == false {
-		g.GoBack()
-		ch <- failed
-		return
+	if err == nil {
+		err = r.phase("guest", func() error {
+			return vmObj.vmProcess(ctx, client, opts.Timeouts, newVM.InventoryPath, !forked)
+		})
+	}
+	if err == nil && vmObj.hasGuestCommands() {
+		err = r.phase("commands", func() error {
+			return step(ctx, t.Commands, vmObj.name, "post commands", func(ctx context.Context) error {
+				// the customization may have restarted the tools
+				if err := waitForTools(ctx, newVM); err != nil {
+					return err
+				}
+				return vmObj.runPostCommands(ctx, newVM, auth)
+			})
+		})
+	}
+	// a fork has the addresses of the source until the post commands
+	// applied its guestinfo
+	if err == nil && forked {
+		err = r.phase("ip", func() error {
+			return step(ctx, t.IP, vmObj.name, "wait for ip", func(ctx context.Context) error {
+				return waitForGuestIPs(ctx, newVM, vmObj.staticIPs())
+			})
+		})
+	}
+
+	if newVM != nil {
+		r.MoRef = newVM.Reference().Value
+		if r.Host == "" {
+			// picked by drs or by load
+			r.Host, _ = vmHostName(ctx, newVM)
+		}
 	}
-	ch <- succ
+
+	// leave no half configured vm behind unless asked to
+	if err != nil && newVM != nil && !opts.KeepOnFailure {
+		rstart := time.Now()
+		rerr := vmObj.rollback(newVM)
+		r.addPhase("rollback", time.Since(rstart))
+		if rerr != nil {
+			r.RollbackError = rerr.Error()
+		} else {
+			r.RolledBack = true
+			newVM = nil
+		}
+	}
+	// no clone takes the memory counted on its host
+	if newVM == nil {
+		placed.release(p)
+	}
+
+	if newVM != nil {
+		// ctx may be cancelled already, the state is still worth reporting
+		sctx, cancel := context.WithTimeout(context.Background(), cancelTaskTimeout)
+		if state, err := newVM.PowerState(sctx); err == nil {
+			r.PowerState = string(state)
+		}
+		cancel()
+	}
+	if err == nil {
+		r.Action = ActionCreated
+	}
+	r.finish()
+	return *r
 }
 
-func CloneVM() {
-	//declare the channel
-	ch := make(chan string, 2)
+// CloneVM clones every vm listed in the vmlist file with the given vCenter
+// config, at most opts.Parallel at a time. It returns one result per vm,
+// and an error when any vm could not be cloned.
+//
+// Cancelling ctx stops queued clones and cancels the running vCenter tasks.
+func CloneVM(ctx context.Context, vmAuth *Config, vmlistPath string, opts CloneOptions) ([]CloneResult, error) {
 	// create vm instants from config file
-	vmObjs := createVMObjs()
-	g.Check(len(vmObjs) == 0, "create vm insts error", nil)
-	if !g.Gret {
-		g.GoBack()
-		msg.Err("create vms error")
-	}
-	// init auth for vCenter
-	var vmAuth Config
-	vmAuth.User = "root"
-	vmAuth.Password = "VMware"
-	vmAuth.VCenterServer = "10.10.221.45"
+	vmObjs, err := vmAuth.loadVMs(vmlistPath)
+	if err != nil {
+		return nil, err
+	}
 
 	// connect to vCenter
-	client, err := vmAuth.Client()
-	g.Check(err != nil, "Create vcenter client error", err)
-	if g.Gret == false {
-		g.GoBack()
-		return
+	client, err := vmAuth.Client(ctx)
+	if err != nil {
+		return nil, err
 	}
+
+	// fail before any clone rather than after the guest is up
+	auth := vmAuth.guestAuth()
+	for i := range vmObjs {
+		if err := vmObjs[i].checkCommandAuth(auth, true); err != nil {
+			return nil, err
+		}
+	}
+
+	// hand out the pool addresses before any vm needs its ip
+	if err := allocateAddresses(ctx, client, vmObjs, vmAuth.LeaseFile, !opts.Plan); err != nil {
+		return nil, err
+	}
+
 	// go tasks
-	for index, vm := range vmObjs {
-		if &vm != nil {
-			go worker(&vmObjs[index], client, ch)
+	placed := newPlacedMemory()
+	results := make([]CloneResult, len(vmObjs))
+	skipped := runPool(ctx, vmObjs, opts, func(i int, claimHost claimHostFunc) {
+		msg.Info("TASK: " + strconv.Itoa(i) + " --> Clone vm " + vmObjs[i].IPAddr() + " started")
+		if opts.Ensure {
+			results[i] = ensure(ctx, &vmObjs[i], client, auth, opts, claimHost, placed)
+		} else {
+			results[i] = worker(ctx, &vmObjs[i], client, auth, opts, claimHost, placed)
+		}
+		if results[i].Failed() {
+			msg.Err("TASK: " + strconv.Itoa(i) + " --> Clone vm " + vmObjs[i].IPAddr() + " failed ! " + results[i].Error)
+			return
+		}
+		msg.Info("TASK: " + strconv.Itoa(i) + " --> Clone vm " + vmObjs[i].IPAddr() + " succeed !")
+	})
+	// queued when the run was cancelled
+	for _, i := range skipped {
+		r := newCloneResult(&vmObjs[i])
+		r.phase("queue", func() error {
+			return newError(ErrUnknown, vmObjs[i].name, "start clone", ctx.Err())
+		})
+		r.finish()
+		results[i] = *r
+	}
+
+	var failed int
+	var gone []string
+	for i, r := range results {
+		if r.Failed() {
+			failed++
+		}
+		// rolled back, never created or never started
+		if r.RolledBack || (r.MoRef == "" && (r.FailedPhase == "clone" || r.FailedPhase == "queue")) {
+			gone = append(gone, vmObjs[i].name)
+		}
+	}
+	// a failed clone leaves no vm to hold its pool addresses
+	if len(gone) > 0 && usesPools(vmObjs) && !opts.Plan {
+		if err := releaseLeases(vmAuth.LeaseFile, gone); err != nil {
+			msg.Warn("release the leases of failed clones: %s", err)
 		}
 	}
-	for i := 0; i < len(vmObjs); i++ {
-		msg.Info("TASK: " + strconv.Itoa(i) + " --> Clone vm " + <-ch)
+	if failed > 0 {
+		return results, fmt.Errorf("%d of %d vms failed to clone", failed, len(vmObjs))
 	}
+	return results, nil
 }
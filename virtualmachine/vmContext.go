@@ -0,0 +1,165 @@
+package virtualmachine
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Masterminds/glide/msg"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"golang.org/x/net/context"
+)
+
+const (
+	// how long a task cancel may take once the caller gave up
+	cancelTaskTimeout = 30 * time.Second
+	// how long destroying the vm of a failed clone may take
+	rollbackTimeout = 10 * time.Minute
+)
+
+// Timeouts bounds each phase of a clone, 0 means no deadline.
+type Timeouts struct {
+	Clone   time.Duration // inventory lookups, then clone task, not the wait for a host
+	PowerOn time.Duration // power on task and wait for poweredOn
+	Tools   time.Duration // wait for VMware Tools to run in the guest
+	IP      time.Duration // wait for the guest to report an ip
+	// Commands bounds the post commands of a vm together
+	Commands time.Duration
+}
+
+// DefaultTimeouts are used by the command line unless overridden.
+var DefaultTimeouts = Timeouts{
+	Clone:   30 * time.Minute,
+	PowerOn: 5 * time.Minute,
+	Tools:   10 * time.Minute,
+	IP:      10 * time.Minute,
+
+	Commands: 30 * time.Minute,
+}
+
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// step runs fn for op of vm under a deadline of d. A deadline or a cancel
+// ending the step is reported as ErrTimeout or ErrCanceled.
+func step(ctx context.Context, d time.Duration, vm, op string, fn func(ctx context.Context) error) error {
+	sctx, cancel := withTimeout(ctx, d)
+	defer cancel()
+
+	err := fn(sctx)
+	if err == nil {
+		return nil
+	}
+	switch sctx.Err() {
+	case context.DeadlineExceeded:
+		return &Error{Kind: ErrTimeout, VM: vm, Op: op, Err: fmt.Errorf("gave up after %s: %s", d, err)}
+	case context.Canceled:
+		return &Error{Kind: ErrCanceled, VM: vm, Op: op, Err: err}
+	}
+	return newError(ErrUnknown, vm, op, err)
+}
+
+// changeDevices adds, edits or removes devices of vm like AddDevice,
+// EditDevice and RemoveDevice, but waits with waitTask so a cancelled run
+// cancels the reconfigure task in vCenter too.
+func changeDevices(ctx context.Context, vm *object.VirtualMachine, op types.VirtualDeviceConfigSpecOperation, devices ...types.BaseVirtualDevice) error {
+	var spec types.VirtualMachineConfigSpec
+	for _, d := range devices {
+		change := &types.VirtualDeviceConfigSpec{Device: d, Operation: op}
+		if _, ok := d.(*types.VirtualDisk); ok {
+			switch op {
+			case types.VirtualDeviceConfigSpecOperationAdd:
+				change.FileOperation = types.VirtualDeviceConfigSpecFileOperationCreate
+			case types.VirtualDeviceConfigSpecOperationRemove:
+				change.FileOperation = types.VirtualDeviceConfigSpecFileOperationDestroy
+			}
+		}
+		spec.DeviceChange = append(spec.DeviceChange, change)
+	}
+	task, err := vm.Reconfigure(ctx, spec)
+	if err != nil {
+		return err
+	}
+	_, err = waitTask(ctx, task)
+	return err
+}
+
+// waitTask waits for task and cancels it in vCenter when ctx ends first, so
+// an interrupted run leaves no task behind.
+func waitTask(ctx context.Context, task *object.Task) (*types.TaskInfo, error) {
+	info, err := task.WaitForResult(ctx, nil)
+	if err != nil && ctx.Err() != nil {
+		cctx, cancel := context.WithTimeout(context.Background(), cancelTaskTimeout)
+		defer cancel()
+		req := types.CancelTask{This: task.Reference()}
+		if _, cerr := methods.CancelTask(cctx, task.Client(), &req); cerr != nil {
+			msg.Warn("cancel task %s: %s", task.Reference().Value, cerr)
+		}
+	}
+	return info, err
+}
+
+// waitForTools polls until VMware Tools run in the guest.
+func waitForTools(ctx context.Context, vm *object.VirtualMachine) error {
+	for {
+		running, err := vm.IsToolsRunning(ctx)
+		if err != nil {
+			return err
+		}
+		if running {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// waitForGuestIPs polls until the guest reports every address of ips on
+// its nics, or any address when ips is empty.
+func waitForGuestIPs(ctx context.Context, vm *object.VirtualMachine, ips []string) error {
+	for {
+		var mvm mo.VirtualMachine
+		if err := vm.Properties(ctx, vm.Reference(), []string{"guest.ipAddress", "guest.net"}, &mvm); err != nil {
+			return err
+		}
+		if mvm.Guest != nil && hasIPs(mvm.Guest, ips) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func hasIPs(g *types.GuestInfo, ips []string) bool {
+	if len(ips) == 0 {
+		return g.IpAddress != ""
+	}
+	for _, want := range ips {
+		wantIP := net.ParseIP(want)
+		var found bool
+		for _, nic := range g.Net {
+			for _, have := range nic.IpAddress {
+				if net.ParseIP(have).Equal(wantIP) {
+					found = true
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
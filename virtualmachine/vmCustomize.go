@@ -0,0 +1,213 @@
+package virtualmachine
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const (
+	// sysprep time zone index of (GMT) Greenwich Mean Time
+	defaultWindowsTimeZone = 85
+	// sysprep requires a user and an organization
+	defaultSysprepName = "vms"
+	defaultWorkgroup   = "WORKGROUP"
+)
+
+var invalidHostChars = regexp.MustCompile("[^a-zA-Z0-9-]+")
+
+// isWindowsGuest reports whether guestID names a Windows guest os.
+func isWindowsGuest(guestID string) bool {
+	windows, _ := regexp.MatchString("windows", guestID)
+	return windows
+}
+
+// hostName returns the guest host name of vm: the first dot separated
+// part of its host name or else its name, cut down to the characters a
+// host name allows.
+func (vm *virtualMachine) hostName() string {
+	name := strings.Split(orDefault(vm.guestHostName, vm.name), ".")[0]
+	name = strings.Trim(invalidHostChars.ReplaceAllString(name, "-"), "-")
+	if len(name) > 63 {
+		name = strings.TrimRight(name[:63], "-")
+	}
+	return name
+}
+
+// computerName cuts hostName to the NetBIOS limit of a Windows computer
+// name.
+func computerName(hostName string) string {
+	if len(hostName) > 15 {
+		return strings.TrimRight(hostName[:15], "-")
+	}
+	return hostName
+}
+
+// customizationSpec builds the guest customization of vm: LinuxPrep, or
+// Sysprep for a Windows guestID, and the ip settings of the nics nics
+// the clone ends up with.
+func (vm *virtualMachine) customizationSpec(guestID string, nics int) (*types.CustomizationSpec, error) {
+	hostName := vm.hostName()
+	if hostName == "" {
+		return nil, fmt.Errorf("cannot derive a host name from '%s'", vm.name)
+	}
+
+	nicSettings, err := vm.nicSettings(nics)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := &types.CustomizationSpec{
+		GlobalIPSettings: types.CustomizationGlobalIPSettings{
+			DnsSuffixList: vm.dnsSuffixes,
+			DnsServerList: vm.dnsServers,
+		},
+		NicSettingMap: nicSettings,
+	}
+
+	if !isWindowsGuest(guestID) {
+		spec.Identity = &types.CustomizationLinuxPrep{
+			HostName:   &types.CustomizationFixedName{Name: hostName},
+			Domain:     vm.domain,
+			TimeZone:   vm.timeZone,
+			HwClockUTC: types.NewBool(true),
+		}
+		return spec, nil
+	}
+
+	sysprep, err := vm.sysprep(hostName)
+	if err != nil {
+		return nil, err
+	}
+	spec.Identity = sysprep
+	return spec, nil
+}
+
+// sysprep builds the Windows identity of vm with computer name hostName.
+func (vm *virtualMachine) sysprep(hostName string) (*types.CustomizationSysprep, error) {
+	w := vm.windows
+
+	timeZone := defaultWindowsTimeZone
+	if vm.timeZone != "" {
+		var err error
+		timeZone, err = strconv.Atoi(vm.timeZone)
+		if err != nil {
+			return nil, fmt.Errorf("timeZone '%s' of a Windows guest must be a sysprep time zone index", vm.timeZone)
+		}
+	}
+	sysprep := &types.CustomizationSysprep{
+		GuiUnattended: types.CustomizationGuiUnattended{
+			TimeZone:       timeZone,
+			AutoLogon:      w.autoLogonCount > 0,
+			AutoLogonCount: w.autoLogonCount,
+		},
+		UserData: types.CustomizationUserData{
+			FullName:     orDefault(w.fullName, defaultSysprepName),
+			OrgName:      orDefault(w.orgName, defaultSysprepName),
+			ComputerName: &types.CustomizationFixedName{Name: computerName(hostName)},
+			ProductId:    w.productKey,
+		},
+	}
+	if w.adminPassword != "" {
+		sysprep.GuiUnattended.Password = plainPassword(w.adminPassword)
+	}
+
+	if w.joinDomain != "" {
+		sysprep.Identification = types.CustomizationIdentification{
+			JoinDomain:          w.joinDomain,
+			DomainAdmin:         w.domainUser,
+			DomainAdminPassword: plainPassword(w.domainPassword),
+		}
+	} else {
+		sysprep.Identification = types.CustomizationIdentification{
+			JoinWorkgroup: orDefault(w.workgroup, defaultWorkgroup),
+		}
+	}
+
+	if len(w.runOnce) > 0 {
+		sysprep.GuiRunOnce = &types.CustomizationGuiRunOnce{CommandList: w.runOnce}
+	}
+	return sysprep, nil
+}
+
+func plainPassword(password string) *types.CustomizationPassword {
+	return &types.CustomizationPassword{Value: password, PlainText: true}
+}
+
+func orDefault(value, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
+
+// ipv6Settings returns the ipv6 setup of network, nil when it has none.
+func (vm *virtualMachine) ipv6Settings(network networkInterface) (*types.CustomizationIPSettingsIpV6AddressSpec, error) {
+	var ip types.BaseCustomizationIpV6Generator
+	switch network.ipv6Mode() {
+	case ipv6Static:
+		if network.ipv6PrefixLength == 0 {
+			return nil, fmt.Errorf("ipv6PrefixLength is empty for %s", network.ipv6Address)
+		}
+		ip = &types.CustomizationFixedIpV6{
+			IpAddress:  network.ipv6Address,
+			SubnetMask: network.ipv6PrefixLength,
+		}
+	case ipv6SLAAC:
+		ip = &types.CustomizationAutoIpV6Generator{}
+	case ipv6DHCP:
+		ip = &types.CustomizationDhcpIpV6Generator{}
+	default:
+		return nil, nil
+	}
+
+	spec := &types.CustomizationIPSettingsIpV6AddressSpec{
+		Ip: []types.BaseCustomizationIpV6Generator{ip},
+	}
+	if gateway := vm.nicIPv6Gateway(network); gateway != "" {
+		spec.Gateway = []string{gateway}
+	}
+	return spec, nil
+}
+
+// nicSettings returns one adapter mapping per nic of the clone. Nics
+// without a spec entry, kept from the template, use dhcp.
+func (vm *virtualMachine) nicSettings(nics int) ([]types.CustomizationAdapterMapping, error) {
+	if len(vm.networkInterfaces) > nics {
+		return nil, fmt.Errorf("%d networkInterfaces but the clone has %d nics", len(vm.networkInterfaces), nics)
+	}
+
+	var settings []types.CustomizationAdapterMapping
+	for _, network := range vm.networkInterfaces {
+		ipSetting := types.CustomizationIPSettings{
+			Ip: &types.CustomizationDhcpIpGenerator{},
+		}
+		if network.ipv4Address != "" {
+			if network.ipv4PrefixLength == 0 {
+				return nil, fmt.Errorf("ipv4PrefixLength is empty for %s", network.ipv4Address)
+			}
+			m := net.CIDRMask(network.ipv4PrefixLength, 32)
+			ipSetting.Ip = &types.CustomizationFixedIp{IpAddress: network.ipv4Address}
+			ipSetting.SubnetMask = net.IPv4(m[0], m[1], m[2], m[3]).String()
+			if gateway := vm.nicGateway(network); gateway != "" {
+				ipSetting.Gateway = []string{gateway}
+			}
+		}
+		ipv6, err := vm.ipv6Settings(network)
+		if err != nil {
+			return nil, err
+		}
+		ipSetting.IpV6Spec = ipv6
+		settings = append(settings, types.CustomizationAdapterMapping{Adapter: ipSetting})
+	}
+	for len(settings) < nics {
+		settings = append(settings, types.CustomizationAdapterMapping{
+			Adapter: types.CustomizationIPSettings{Ip: &types.CustomizationDhcpIpGenerator{}},
+		})
+	}
+	return settings, nil
+}
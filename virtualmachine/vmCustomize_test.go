@@ -0,0 +1,165 @@
+package virtualmachine
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestHostName(t *testing.T) {
+	long := "a23456789-123456789-123456789-123456789-123456789-123456789-12-4"
+	tests := []struct {
+		name, guestHostName string
+		want                string
+	}{
+		{"web-01", "", "web-01"},
+		{"web-01.lab.example.com", "", "web-01"},
+		{"web_01 (copy)", "", "web-01-copy"},
+		{"vm", "db-primary.lab", "db-primary"},
+		{"--x--", "", "x"},
+		{long, "", long[:62]},
+	}
+	for _, tt := range tests {
+		vm := &virtualMachine{name: tt.name, guestHostName: tt.guestHostName}
+		if got := vm.hostName(); got != tt.want {
+			t.Errorf("hostName of %q/%q = %q, want %q", tt.name, tt.guestHostName, got, tt.want)
+		}
+	}
+}
+
+func TestComputerName(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"web-01", "web-01"},
+		{"123456789012345", "123456789012345"},
+		{"1234567890123456", "123456789012345"},
+		{"12345678901234-6", "12345678901234"},
+		{"1234567890123--67", "1234567890123"},
+	}
+	for _, tt := range tests {
+		if got := computerName(tt.in); got != tt.want {
+			t.Errorf("computerName(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNICSettings(t *testing.T) {
+	tests := []struct {
+		name    string
+		nics    []networkInterface
+		count   int
+		ips     []string // fixed address, mask and gateway per mapping, empty for dhcp
+		wantErr string
+	}{
+		{"static", []networkInterface{{ipv4Address: "10.0.0.5", ipv4PrefixLength: 24}}, 1, []string{"10.0.0.5 255.255.255.0 10.0.0.1"}, ""},
+		{"outside the vm gateway", []networkInterface{{ipv4Address: "10.1.0.5", ipv4PrefixLength: 16}}, 1, []string{"10.1.0.5 255.255.0.0 "}, ""},
+		{"dhcp", []networkInterface{{}}, 1, []string{""}, ""},
+		{"template nics", []networkInterface{{ipv4Address: "10.0.0.5", ipv4PrefixLength: 24}}, 3, []string{"10.0.0.5 255.255.255.0 10.0.0.1", "", ""}, ""},
+		{"no prefix", []networkInterface{{ipv4Address: "10.0.0.5"}}, 1, nil, "ipv4PrefixLength is empty"},
+		{"more nics than the clone", []networkInterface{{}, {}}, 1, nil, "2 networkInterfaces but the clone has 1 nics"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := &virtualMachine{name: "vm", gateway: "10.0.0.1", networkInterfaces: tt.nics}
+			settings, err := vm.nicSettings(tt.count)
+			checkErr(t, err, tt.wantErr)
+			if err != nil {
+				return
+			}
+			if len(settings) != len(tt.ips) {
+				t.Fatalf("%d mappings, want %d", len(settings), len(tt.ips))
+			}
+			for i, m := range settings {
+				got := ""
+				if fixed, ok := m.Adapter.Ip.(*types.CustomizationFixedIp); ok {
+					gateway := ""
+					if len(m.Adapter.Gateway) > 0 {
+						gateway = m.Adapter.Gateway[0]
+					}
+					got = fixed.IpAddress + " " + m.Adapter.SubnetMask + " " + gateway
+				} else if _, ok := m.Adapter.Ip.(*types.CustomizationDhcpIpGenerator); !ok {
+					t.Errorf("mapping %d is %T", i, m.Adapter.Ip)
+				}
+				if got != tt.ips[i] {
+					t.Errorf("mapping %d = %q, want %q", i, got, tt.ips[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCustomizationSpec(t *testing.T) {
+	vm := &virtualMachine{
+		name:              "web-01.lab",
+		domain:            "lab.local",
+		timeZone:          "Etc/UTC",
+		dnsServers:        []string{"10.0.0.2"},
+		networkInterfaces: []networkInterface{{ipv4Address: "10.0.0.5", ipv4PrefixLength: 24}},
+	}
+	spec, err := vm.customizationSpec("centos64Guest", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	linux, ok := spec.Identity.(*types.CustomizationLinuxPrep)
+	if !ok {
+		t.Fatalf("identity %T, want linux prep", spec.Identity)
+	}
+	if name := linux.HostName.(*types.CustomizationFixedName).Name; name != "web-01" || linux.Domain != "lab.local" || linux.TimeZone != "Etc/UTC" {
+		t.Errorf("linux prep %+v with host name %s", linux, name)
+	}
+	if len(spec.NicSettingMap) != 1 || spec.GlobalIPSettings.DnsServerList[0] != "10.0.0.2" {
+		t.Errorf("spec %+v", spec)
+	}
+
+	vm.timeZone = ""
+	spec, err = vm.customizationSpec("windows9Server64Guest", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := spec.Identity.(*types.CustomizationSysprep); !ok {
+		t.Errorf("identity %T, want sysprep", spec.Identity)
+	}
+
+	vm.name = "..."
+	_, err = vm.customizationSpec("centos64Guest", 1)
+	checkErr(t, err, "cannot derive a host name")
+}
+
+func TestIPv6Settings(t *testing.T) {
+	tests := []struct {
+		name    string
+		nic     networkInterface
+		ip      string // type of the generator, empty for no ipv6
+		gateway string
+		wantErr string
+	}{
+		{"none", networkInterface{}, "", "", ""},
+		{"static", networkInterface{ipv6Address: "fd00::5", ipv6PrefixLength: 64}, "*types.CustomizationFixedIpV6", "fd00::1", ""},
+		{"static without prefix", networkInterface{ipv6Address: "fd00::5"}, "", "", "ipv6PrefixLength is empty"},
+		{"slaac", networkInterface{ipv6AddrMode: ipv6SLAAC}, "*types.CustomizationAutoIpV6Generator", "", ""},
+		{"dhcp", networkInterface{ipv6AddrMode: ipv6DHCP}, "*types.CustomizationDhcpIpV6Generator", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := &virtualMachine{ipv6Gateway: "fd00::1", networkInterfaces: []networkInterface{tt.nic}}
+			spec, err := vm.ipv6Settings(tt.nic)
+			checkErr(t, err, tt.wantErr)
+			if err != nil {
+				return
+			}
+			if tt.ip == "" {
+				if spec != nil {
+					t.Errorf("got %+v, want no ipv6", spec)
+				}
+				return
+			}
+			if got := fmt.Sprintf("%T", spec.Ip[0]); got != tt.ip {
+				t.Errorf("generator %s, want %s", got, tt.ip)
+			}
+			if got := strings.Join(spec.Gateway, ","); got != tt.gateway {
+				t.Errorf("gateway %q, want %q", got, tt.gateway)
+			}
+		})
+	}
+}
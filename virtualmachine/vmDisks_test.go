@@ -0,0 +1,136 @@
+package virtualmachine
+
+import (
+	"testing"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func unit(n int) *int { return &n }
+
+func TestValidateDiskPlacement(t *testing.T) {
+	tests := []struct {
+		name       string
+		controller string
+		unit       *int
+		mode       string
+		want       string
+	}{
+		{"defaults", "", nil, "", ""},
+		{"scsi unit", controllerParaVirtual, unit(15), "", ""},
+		{"scsi unit too high", controllerLsiLogic, unit(16), "", "not between 0 and 15"},
+		{"scsi controller unit", "", unit(7), "", "taken by the scsi controller"},
+		{"sata unit", controllerSATA, unit(29), "", ""},
+		{"sata unit 7", controllerSATA, unit(7), "", ""},
+		{"sata unit too high", controllerSATA, unit(30), "", "not between 0 and 29"},
+		{"negative unit", "", unit(-1), "", "not between"},
+		{"nvme", controllerNVMe, nil, "", "not supported"},
+		{"unknown controller", "ide", nil, "", "is not one of"},
+		{"disk mode", "", nil, "independent_persistent", ""},
+		{"unknown disk mode", "", nil, "thin", "diskMode 'thin'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkErr(t, validateDiskPlacement(tt.controller, tt.unit, tt.mode), tt.want)
+		})
+	}
+}
+
+// diskOn returns a disk on unit n of the controller with key.
+func diskOn(key, n int) *types.VirtualDisk {
+	return &types.VirtualDisk{VirtualDevice: types.VirtualDevice{ControllerKey: key, UnitNumber: unit(n)}}
+}
+
+// scsiController returns an lsilogic controller with key.
+func scsiController(key int) *types.VirtualLsiLogicController {
+	c := &types.VirtualLsiLogicController{}
+	c.Key = key
+	return c
+}
+
+// sataController returns an ahci controller with key.
+func sataController(key int) *types.VirtualAHCIController {
+	c := &types.VirtualAHCIController{}
+	c.Key = key
+	return c
+}
+
+func TestSetUnitNumber(t *testing.T) {
+	fullSCSI := object.VirtualDeviceList{scsiController(1000)}
+	for n := 0; n < scsiUnits; n++ {
+		if n != scsiReserved {
+			fullSCSI = append(fullSCSI, diskOn(1000, n))
+		}
+	}
+	tests := []struct {
+		name    string
+		devices object.VirtualDeviceList
+		unit    *int
+		got     int
+		want    string
+	}{
+		{"first free", object.VirtualDeviceList{scsiController(1000), diskOn(1000, 0)}, nil, 1, ""},
+		{"skips the scsi controller unit", object.VirtualDeviceList{scsiController(1000), diskOn(1000, 0), diskOn(1000, 1), diskOn(1000, 2), diskOn(1000, 3), diskOn(1000, 4), diskOn(1000, 5), diskOn(1000, 6)}, nil, 8, ""},
+		{"full scsi bus", fullSCSI, nil, 0, "no free unit"},
+		{"requested unit", object.VirtualDeviceList{scsiController(1000)}, unit(3), 3, ""},
+		{"requested unit taken", object.VirtualDeviceList{scsiController(1000), diskOn(1000, 3)}, unit(3), 0, "unit 3"},
+		{"scsi unit past the bus", object.VirtualDeviceList{scsiController(1000)}, unit(20), 0, "unit 20"},
+		{"sata unit 7", object.VirtualDeviceList{sataController(15000)}, unit(7), 7, ""},
+		{"sata past scsi units", object.VirtualDeviceList{sataController(15000)}, unit(20), 20, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			controller := tt.devices[0].(types.BaseVirtualController)
+			disk := &types.VirtualDisk{}
+			err := setUnitNumber(tt.devices, controller, disk, tt.unit)
+			checkErr(t, err, tt.want)
+			if err == nil && *disk.UnitNumber != tt.got {
+				t.Errorf("unit %d, want %d", *disk.UnitNumber, tt.got)
+			}
+		})
+	}
+}
+
+func TestPickController(t *testing.T) {
+	devices := object.VirtualDeviceList{
+		scsiController(1000), diskOn(1000, 0), diskOn(1000, 1),
+		scsiController(1001),
+		sataController(15000), diskOn(15000, 0),
+	}
+	tests := []struct {
+		name string
+		kind string
+		unit *int
+		want int // key of the controller, 0 for none
+	}{
+		{"any scsi", "", nil, 1000},
+		{"scsi with the unit free", "", unit(1), 1001},
+		{"scsi with the unit free on the first", "", unit(2), 1000},
+		{"scsi controller unit", "", unit(7), 0},
+		{"lsilogic", controllerLsiLogic, unit(0), 1001},
+		{"no pvscsi", controllerParaVirtual, nil, 0},
+		{"sata", controllerSATA, nil, 15000},
+		{"sata unit taken", controllerSATA, unit(0), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := 0
+			if c := pickController(devices, tt.kind, tt.unit); c != nil {
+				got = c.GetVirtualController().Key
+			}
+			if got != tt.want {
+				t.Errorf("controller %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKnownDevices(t *testing.T) {
+	if err := knownDevices(object.VirtualDeviceList{scsiController(1000), diskOn(1000, 0)}); err != nil {
+		t.Error(err)
+	}
+	// how a VirtualNVMEController reads back with these bindings
+	err := knownDevices(object.VirtualDeviceList{scsiController(1000), nil})
+	checkErr(t, err, "device 1 is of a type this build cannot read")
+}
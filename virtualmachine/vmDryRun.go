@@ -0,0 +1,199 @@
+package virtualmachine
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
+	"golang.org/x/net/context"
+)
+
+// DryRunResult is what a clone of one vm would use, or why it would fail.
+type DryRunResult struct {
+	Name         string   `json:"name"`
+	Template     string   `json:"template"`
+	GuestID      string   `json:"guestId,omitempty"`
+	ResourcePool string   `json:"resourcePool,omitempty"`
+	Host         string   `json:"host,omitempty"`
+	Folder       string   `json:"folder,omitempty"`
+	Datastore    string   `json:"datastore,omitempty"`
+	Networks     []string `json:"networks,omitempty"`
+	Addresses    []string `json:"addresses,omitempty"`
+	// Snapshot is the template snapshot of a linked clone
+	Snapshot string `json:"snapshot,omitempty"`
+	// Instant is set when the clone forks the running template
+	Instant bool `json:"instant,omitempty"`
+	// Fallback is why an instant clone would be made linked
+	Fallback string `json:"fallback,omitempty"`
+	// CustomizationSpec is the vCenter spec the guest setup starts from
+	CustomizationSpec string   `json:"customizationSpec,omitempty"`
+	Errors            []string `json:"errors,omitempty"`
+}
+
+// DryRun resolves every vm of the vmlist file the way CloneVM would and
+// checks its network settings and that it does not exist yet, without
+// creating anything. Every error found is listed per vm. It returns an
+// error when any vm would fail.
+func DryRun(ctx context.Context, vmAuth *Config, vmlistPath string) ([]DryRunResult, error) {
+	vmObjs, err := vmAuth.loadVMs(vmlistPath)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := vmAuth.Client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// pick the pool addresses a clone would lease, without keeping them
+	if err := allocateAddresses(ctx, client, vmObjs, vmAuth.LeaseFile, false); err != nil {
+		return nil, err
+	}
+
+	// spread the vms placed by load the way the clones would
+	placed := newPlacedMemory()
+	results := make([]DryRunResult, len(vmObjs))
+	seen := make(map[string]string)
+	var failed int
+	for i := range vmObjs {
+		vm := &vmObjs[i]
+		r := &results[i]
+		r.Name = vm.name
+		r.Template = vm.template
+		r.CustomizationSpec = vm.specName()
+		r.Addresses = vm.staticIPs()
+
+		for _, err := range vm.validateNetwork() {
+			r.Errors = append(r.Errors, newError(ErrInvalidSpec, vm.name, "validate network", err).Error())
+		}
+		for _, ip := range vm.staticIPs() {
+			// one spelling per address, ipv6 has many
+			key := net.ParseIP(ip).String()
+			if other, ok := seen[key]; ok {
+				r.Errors = append(r.Errors, fmt.Sprintf("ip %s is also used by %s", ip, other))
+			}
+			seen[key] = vm.name
+		}
+
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+		// the clone would fail on a vm of the same name
+		existing, _, err := vm.findExisting(ctx, client)
+		switch {
+		case err != nil:
+			r.Errors = append(r.Errors, err.Error())
+		case existing != nil:
+			r.Errors = append(r.Errors, newError(ErrInvalidSpec, vm.name, "find existing vm",
+				fmt.Errorf("%s already exists, use --ensure to reconcile it", vm.Path())).Error())
+		}
+
+		p, errs := vm.resolveAll(ctx, client, placed)
+		for _, err := range errs {
+			r.Errors = append(r.Errors, err.Error())
+		}
+		if p != nil {
+			r.fill(ctx, p)
+			switch {
+			case p.createSnapshot:
+				r.Snapshot = vm.snapshot + " (created by the first clone)"
+			case p.snapshot != nil:
+				r.Snapshot = orDefault(vm.snapshot, "current "+p.snapshot.Value)
+			}
+			r.Instant = vm.instant && p.fallback == ""
+			r.Fallback = p.fallback
+		}
+		windows := p == nil || p.guestID == "" || isWindowsGuest(p.guestID)
+		if err := vm.checkCommandAuth(vmAuth.guestAuth(), windows); err != nil {
+			r.Errors = append(r.Errors, err.Error())
+		}
+		if len(r.Errors) > 0 {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return results, fmt.Errorf("%d of %d vms would fail to clone", failed, len(vmObjs))
+	}
+	return results, nil
+}
+
+// fill records what p resolved; after errors some of it is missing.
+func (r *DryRunResult) fill(ctx context.Context, p *placement) {
+	r.GuestID = p.guestID
+	if p.resourcePool != nil {
+		r.ResourcePool = p.resourcePool.InventoryPath
+	}
+	r.Host = p.hostName
+	if p.drs != "" {
+		r.Host = "drs of " + p.drs
+	}
+	if p.folder != nil {
+		r.Folder = p.folder.InventoryPath
+		if r.Folder == "" {
+			r.Folder = p.folder.Reference().Value
+		}
+	}
+	if p.datastore != nil {
+		r.Datastore = datastoreName(ctx, p.datastore)
+	}
+	for _, nic := range p.nics {
+		name, err := nicNetworkName(ctx, p.dc, nic)
+		if err != nil {
+			name = err.Error()
+		}
+		r.Networks = append(r.Networks, name)
+	}
+}
+
+// datastoreName returns the name of ds, which has no inventory path when
+// Storage DRS picked it.
+func datastoreName(ctx context.Context, ds *object.Datastore) string {
+	if ds.InventoryPath != "" {
+		return ds.Name()
+	}
+	var mds mo.Datastore
+	if err := ds.Properties(ctx, ds.Reference(), []string{"name"}, &mds); err != nil {
+		return ds.Reference().Value
+	}
+	return mds.Name
+}
+
+// WriteDryRun prints results as a plan for people.
+func WriteDryRun(w io.Writer, results []DryRunResult) {
+	var failed int
+	for _, r := range results {
+		if len(r.Errors) > 0 {
+			failed++
+			fmt.Fprintf(w, "%s: would fail\n", r.Name)
+			for _, e := range r.Errors {
+				fmt.Fprintf(w, "  error: %s\n", e)
+			}
+			continue
+		}
+		fmt.Fprintf(w, "%s: clone of %s (%s)\n", r.Name, r.Template, r.GuestID)
+		fmt.Fprintf(w, "  pool:      %s\n", r.ResourcePool)
+		fmt.Fprintf(w, "  host:      %s\n", r.Host)
+		fmt.Fprintf(w, "  folder:    %s\n", r.Folder)
+		fmt.Fprintf(w, "  datastore: %s\n", r.Datastore)
+		fmt.Fprintf(w, "  networks:  %s\n", strings.Join(r.Networks, ", "))
+		if len(r.Addresses) > 0 {
+			fmt.Fprintf(w, "  addresses: %s\n", strings.Join(r.Addresses, ", "))
+		}
+		if r.Snapshot != "" {
+			fmt.Fprintf(w, "  linked:    %s\n", r.Snapshot)
+		}
+		if r.Instant {
+			fmt.Fprintf(w, "  instant:   forks the running template, linked if vCenter refuses\n")
+		}
+		if r.Fallback != "" {
+			fmt.Fprintf(w, "  instant:   linked instead, %s\n", r.Fallback)
+		}
+		if r.CustomizationSpec != "" {
+			fmt.Fprintf(w, "  spec:      %s\n", r.CustomizationSpec)
+		}
+	}
+	fmt.Fprintf(w, "\n%d ok, %d would fail\n", len(results)-failed, failed)
+}
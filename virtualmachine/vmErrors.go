@@ -0,0 +1,134 @@
+package virtualmachine
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/task"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+	"golang.org/x/net/context"
+)
+
+// ErrorKind classifies a deploy failure so callers can decide how to react.
+type ErrorKind int
+
+const (
+	ErrUnknown     ErrorKind = iota
+	ErrNotFound              // inventory object does not exist
+	ErrPermission            // vCenter refused the login or the operation
+	ErrTaskFault             // a vCenter task failed
+	ErrInvalidSpec           // the vm spec or vmlist is wrong
+	ErrTimeout               // a wait gave up
+	ErrGuest                 // a guest operation failed
+	ErrCanceled              // the run was interrupted
+	ErrPlacement             // no datastore or host was recommended
+)
+
+var kindNames = map[ErrorKind]string{
+	ErrUnknown:     "error",
+	ErrNotFound:    "not found",
+	ErrPermission:  "permission denied",
+	ErrTaskFault:   "task fault",
+	ErrInvalidSpec: "invalid spec",
+	ErrTimeout:     "timeout",
+	ErrGuest:       "guest error",
+	ErrCanceled:    "canceled",
+	ErrPlacement:   "no placement",
+}
+
+func (k ErrorKind) String() string {
+	return kindNames[k]
+}
+
+// Error is returned by every step of the deploy pipeline. It names the vm
+// and the step, and wraps the underlying error.
+type Error struct {
+	Kind ErrorKind
+	VM   string
+	Op   string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.VM == "" {
+		return fmt.Sprintf("%s: %s: %s", e.Op, e.Kind, e.Err)
+	}
+	return fmt.Sprintf("vm %s: %s: %s: %s", e.VM, e.Op, e.Kind, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// newError wraps err as an *Error. ErrUnknown asks for the kind to be
+// derived from err.
+func newError(kind ErrorKind, vm, op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		// already classified by a deeper step
+		if e.VM == "" {
+			e.VM = vm
+		}
+		return err
+	}
+	if kind == ErrUnknown {
+		kind = classify(err)
+	}
+	return &Error{Kind: kind, VM: vm, Op: op, Err: err}
+}
+
+// Kind returns the kind of err, ErrUnknown when it is not an *Error.
+func Kind(err error) ErrorKind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return ErrUnknown
+}
+
+// classify maps govmomi errors and vSphere faults to an ErrorKind.
+func classify(err error) ErrorKind {
+	switch err {
+	case context.DeadlineExceeded:
+		return ErrTimeout
+	case context.Canceled:
+		return ErrCanceled
+	}
+
+	switch e := err.(type) {
+	case *find.NotFoundError, *find.DefaultNotFoundError:
+		return ErrNotFound
+	case task.Error:
+		if isPermissionFault(e.Fault()) {
+			return ErrPermission
+		}
+		return ErrTaskFault
+	}
+
+	if soap.IsSoapFault(err) {
+		if isPermissionFault(soap.ToSoapFault(err).VimFault()) {
+			return ErrPermission
+		}
+	}
+	if soap.IsVimFault(err) {
+		if isPermissionFault(soap.ToVimFault(err)) {
+			return ErrPermission
+		}
+	}
+	return ErrUnknown
+}
+
+func isPermissionFault(fault interface{}) bool {
+	switch fault.(type) {
+	case types.NoPermission, *types.NoPermission,
+		types.NotAuthenticated, *types.NotAuthenticated,
+		types.InvalidLogin, *types.InvalidLogin:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,179 @@
+package virtualmachine
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/glide/msg"
+	"github.com/vmware/govmomi/guest"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"golang.org/x/net/context"
+)
+
+// shells the post commands of a vm can run through
+const (
+	shellSh         = "sh"
+	shellCmd        = "cmd"
+	shellPowerShell = "powershell"
+)
+
+const windowsAdmin = "Administrator"
+
+// guestProgram returns the program spec that runs command through shell.
+func guestProgram(shell, command string) *types.GuestProgramSpec {
+	switch shell {
+	case shellCmd:
+		return &types.GuestProgramSpec{
+			ProgramPath: `C:\Windows\System32\cmd.exe`,
+			Arguments:   "/c " + command,
+		}
+	case shellPowerShell:
+		return &types.GuestProgramSpec{
+			ProgramPath: `C:\Windows\System32\WindowsPowerShell\v1.0\powershell.exe`,
+			Arguments:   "-NoProfile -NonInteractive -ExecutionPolicy Bypass -Command " + command,
+		}
+	}
+	return &types.GuestProgramSpec{
+		ProgramPath:      "/bin/sh",
+		Arguments:        "-c '" + strings.Replace(command, "'", `'\''`, -1) + "'",
+		WorkingDirectory: "/",
+	}
+}
+
+// commandAuth returns the guest login for the post commands: the sysprep
+// administrator of a Windows guest with windows.adminPassword, else the
+// configured guest user, which in a mixed manifest is the linux one.
+func (vm *virtualMachine) commandAuth(auth *types.NamePasswordAuthentication, windows bool) (*types.NamePasswordAuthentication, error) {
+	if windows && vm.windows.adminPassword != "" {
+		return &types.NamePasswordAuthentication{
+			Username: windowsAdmin,
+			Password: vm.windows.adminPassword,
+		}, nil
+	}
+	if auth.Username != "" {
+		return auth, nil
+	}
+	return nil, newError(ErrInvalidSpec, vm.name, "run post commands", fmt.Errorf("guest.user is needed to run postCommands and routes"))
+}
+
+// checkCommandAuth fails when vm has guest commands but no login to run
+// them with. Before the template is looked up the guest may be Windows,
+// so windows.adminPassword is enough.
+func (vm *virtualMachine) checkCommandAuth(auth *types.NamePasswordAuthentication, windows bool) error {
+	if !vm.hasGuestCommands() {
+		return nil
+	}
+	_, err := vm.commandAuth(auth, windows)
+	return err
+}
+
+// configGuestID returns the guest os vm is configured with, set even when
+// its tools never ran.
+func configGuestID(ctx context.Context, vm *object.VirtualMachine) (string, error) {
+	var mvm mo.VirtualMachine
+	if err := vm.Properties(ctx, vm.Reference(), []string{"config.guestId"}, &mvm); err != nil {
+		return "", err
+	}
+	if mvm.Config == nil {
+		return "", nil
+	}
+	return mvm.Config.GuestId, nil
+}
+
+// runPostCommands adds the static routes of vm, then runs its post
+// commands in the guest one by one and fails on the first that does not
+// exit 0.
+func (vm *virtualMachine) runPostCommands(ctx context.Context, vmInst *object.VirtualMachine, auth *types.NamePasswordAuthentication) error {
+	guestID, err := configGuestID(ctx, vmInst)
+	if err != nil {
+		return newError(ErrUnknown, vm.name, "get guest id", err)
+	}
+	windows := isWindowsGuest(guestID)
+
+	shell := vm.shell
+	if shell == "" {
+		shell = shellSh
+		if windows {
+			shell = shellCmd
+		}
+	}
+	auth, err = vm.commandAuth(auth, windows)
+	if err != nil {
+		return err
+	}
+
+	o := guest.NewOperationsManager(vmInst.Client(), vmInst.Reference())
+	pro, err := o.ProcessManager(ctx)
+	if err != nil {
+		return newError(ErrGuest, vm.name, "get guest process manager", err)
+	}
+
+	run := func(op, shell, command string) error {
+		msg.Info("vm %s: run %s", vm.name, command)
+		pid, err := pro.StartProgram(ctx, auth, guestProgram(shell, command))
+		if err != nil {
+			return newError(ErrGuest, vm.name, "start guest program", err)
+		}
+		code, err := waitForProcess(ctx, pro, auth, pid)
+		if err != nil {
+			return newError(ErrGuest, vm.name, "wait for guest program", err)
+		}
+		if code != 0 {
+			return newError(ErrGuest, vm.name, op, fmt.Errorf("'%s' exited %d", command, code))
+		}
+		return nil
+	}
+
+	// route commands are written for the native shell of the guest
+	routeShell := shellSh
+	if windows {
+		routeShell = shellCmd
+	}
+	for _, command := range vm.routeCommands(windows) {
+		if err := run("add static route", routeShell, command); err != nil {
+			return err
+		}
+	}
+	for _, command := range vm.postCommands {
+		if err := run("run post command", shell, command); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasGuestCommands reports whether vm needs commands run in the guest
+// after the customization.
+func (vm *virtualMachine) hasGuestCommands() bool {
+	if len(vm.postCommands) > 0 {
+		return true
+	}
+	for _, n := range vm.networkInterfaces {
+		if len(n.routes) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForProcess polls until the guest process pid ends and returns its
+// exit code.
+func waitForProcess(ctx context.Context, pro *guest.ProcessManager, auth types.BaseGuestAuthentication, pid int64) (int, error) {
+	for {
+		procs, err := pro.ListProcesses(ctx, auth, []int64{pid})
+		if err != nil {
+			return 0, err
+		}
+		if len(procs) == 1 && procs[0].EndTime != nil {
+			return procs[0].ExitCode, nil
+		}
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package virtualmachine
+
+import (
+	"testing"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestCheckCommandAuth(t *testing.T) {
+	user := &types.NamePasswordAuthentication{Username: "root", Password: "pw"}
+	none := &types.NamePasswordAuthentication{}
+	commands := []string{"true"}
+	routes := []networkInterface{{routes: []staticRoute{{to: "10.30.0.0/16", via: "10.20.0.1"}}}}
+
+	tests := []struct {
+		name    string
+		vm      virtualMachine
+		auth    *types.NamePasswordAuthentication
+		windows bool
+		want    string // the login, empty for a failure
+	}{
+		{"no commands", virtualMachine{}, none, false, ""},
+		{"guest user", virtualMachine{postCommands: commands}, user, false, "root"},
+		{"no login", virtualMachine{postCommands: commands}, none, false, ""},
+		{"routes need a login", virtualMachine{networkInterfaces: routes}, none, false, ""},
+		{"windows admin", virtualMachine{postCommands: commands, windows: windowsOptions{adminPassword: "pw"}}, none, true, windowsAdmin},
+		{"windows admin over the guest user", virtualMachine{postCommands: commands, windows: windowsOptions{adminPassword: "pw"}}, user, true, windowsAdmin},
+		{"windows without admin password", virtualMachine{postCommands: commands}, user, true, "root"},
+		{"admin is no linux login", virtualMachine{postCommands: commands, windows: windowsOptions{adminPassword: "pw"}}, none, false, ""},
+		{"linux in a mixed manifest", virtualMachine{postCommands: commands, windows: windowsOptions{adminPassword: "pw"}}, user, false, "root"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.vm.name = "vm"
+			err := tt.vm.checkCommandAuth(tt.auth, tt.windows)
+			if !tt.vm.hasGuestCommands() {
+				if err != nil {
+					t.Errorf("unexpected error: %s", err)
+				}
+				return
+			}
+			if (err != nil) != (tt.want == "") {
+				t.Fatalf("error %v, want login %q", err, tt.want)
+			}
+			auth, err := tt.vm.commandAuth(tt.auth, tt.windows)
+			if err == nil && auth.Username != tt.want {
+				t.Errorf("login %s, want %s", auth.Username, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,264 @@
+package virtualmachine
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"golang.org/x/net/context"
+)
+
+// placedMemory adds up the memory of the clones one run put on a host by
+// load, by host reference; the host quick stats only see them once they
+// run. Every CloneVM and DryRun call keeps its own.
+type placedMemory struct {
+	sync.Mutex
+	mb map[string]int64
+}
+
+func newPlacedMemory() *placedMemory {
+	return &placedMemory{mb: make(map[string]int64)}
+}
+
+// release takes back the memory p counted on its host, for a clone that
+// was never made or was rolled back.
+func (m *placedMemory) release(p *placement) {
+	if p == nil || p.host == nil || p.placedMB == 0 {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	ref := p.host.Reference().Value
+	if m.mb[ref] -= p.placedMB; m.mb[ref] <= 0 {
+		delete(m.mb, ref)
+	}
+	p.placedMB = 0
+}
+
+// hostPlacement is where the clone of a vm runs: host, or nil with drs
+// set when the cluster picks the host.
+type hostPlacement struct {
+	host     *object.HostSystem
+	name     string // of host
+	drs      string // cluster name
+	placedMB int64  // counted on host in placedMemory
+}
+
+// placeHost picks the host for the clone of vm in pool. A named host must
+// belong to the compute resource of pool and be usable. Without one, a drs
+// cluster places the vm itself; otherwise the least loaded usable host is
+// taken. Usable hosts are connected, not in maintenance mode and see ds,
+// the nic networks of vm and, for linked clones, the template datastores.
+// The memory of vm is counted in placed against the host taken by load.
+func (vm *virtualMachine) placeHost(ctx context.Context, c *govmomi.Client, pool *object.ResourcePool, ds *object.Datastore, template *object.VirtualMachine, placed *placedMemory) (*hostPlacement, error) {
+	var mpool mo.ResourcePool
+	if err := pool.Properties(ctx, pool.Reference(), []string{"owner"}, &mpool); err != nil {
+		return nil, err
+	}
+	owner, drs, err := computeResource(ctx, c, mpool.Owner)
+	if err != nil {
+		return nil, err
+	}
+
+	var hosts []mo.HostSystem
+	if len(owner.Host) > 0 {
+		err = property.DefaultCollector(c.Client).Retrieve(ctx, owner.Host, []string{"name", "runtime", "summary", "datastore", "network"}, &hosts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if vm.host != "" {
+		for _, h := range hosts {
+			if h.Name != vm.host {
+				continue
+			}
+			if reason := vm.hostUnusable(ctx, h, ds, nil, nil); reason != "" {
+				return nil, fmt.Errorf("host %s %s", vm.host, reason)
+			}
+			return &hostPlacement{host: object.NewHostSystem(c.Client, h.Self), name: h.Name}, nil
+		}
+		return nil, fmt.Errorf("host %s is not in %s, the compute resource of the resource pool", vm.host, owner.Name)
+	}
+
+	if drs && !vm.hasLinkedDisks() {
+		return &hostPlacement{drs: owner.Name}, nil
+	}
+
+	dc, err := getDatacenter(ctx, c, vm.datacenter)
+	if err != nil {
+		return nil, err
+	}
+	networks, err := vm.nicNetworks(ctx, c, dc, template)
+	if err != nil {
+		return nil, err
+	}
+	var templateDatastores []types.ManagedObjectReference
+	if vm.hasLinkedDisks() {
+		var mvm mo.VirtualMachine
+		if err := template.Properties(ctx, template.Reference(), []string{"datastore"}, &mvm); err != nil {
+			return nil, err
+		}
+		templateDatastores = mvm.Datastore
+	}
+
+	placed.Lock()
+	defer placed.Unlock()
+
+	var best *mo.HostSystem
+	var bestLoad float64
+	var skipped []string
+	for i := range hosts {
+		h := &hosts[i]
+		if reason := vm.hostUnusable(ctx, *h, ds, networks, templateDatastores); reason != "" {
+			skipped = append(skipped, h.Name+" "+reason)
+			continue
+		}
+		load := hostLoad(*h, placed.mb[h.Self.Value])
+		if best == nil || load < bestLoad {
+			best, bestLoad = h, load
+		}
+	}
+	if best == nil {
+		if len(skipped) == 0 {
+			return nil, fmt.Errorf("%s has no hosts", owner.Name)
+		}
+		return nil, fmt.Errorf("no usable host in %s: %s", owner.Name, strings.Join(skipped, "; "))
+	}
+	placed.mb[best.Self.Value] += vm.memoryMb
+	return &hostPlacement{host: object.NewHostSystem(c.Client, best.Self), name: best.Name, placedMB: vm.memoryMb}, nil
+}
+
+// nicNetworks returns the networks the nics of the clone of vm end up on:
+// those of the template with nicPolicy keep, else the labelled ones. A nic
+// without a label takes the only network of dc, nicDeviceChanges reports
+// when there is none.
+func (vm *virtualMachine) nicNetworks(ctx context.Context, c *govmomi.Client, dc *object.Datacenter, template *object.VirtualMachine) ([]mo.Network, error) {
+	if vm.nicPolicy != nicPolicyKeep {
+		var networks []mo.Network
+		for _, n := range vm.networkInterfaces {
+			if n.label == "" {
+				continue
+			}
+			network, err := findNetwork(ctx, dc, n.label)
+			if err != nil {
+				return nil, err
+			}
+			networks = append(networks, *network)
+		}
+		return networks, nil
+	}
+
+	if template == nil {
+		return nil, nil
+	}
+	var mvm mo.VirtualMachine
+	if err := template.Properties(ctx, template.Reference(), []string{"network"}, &mvm); err != nil {
+		return nil, err
+	}
+	var networks []mo.Network
+	if len(mvm.Network) > 0 {
+		if err := property.DefaultCollector(c.Client).Retrieve(ctx, mvm.Network, []string{"name"}, &networks); err != nil {
+			return nil, err
+		}
+	}
+	return networks, nil
+}
+
+// computeResource loads the cluster or standalone host ref and reports
+// whether drs places vms on it.
+func computeResource(ctx context.Context, c *govmomi.Client, ref types.ManagedObjectReference) (*mo.ComputeResource, bool, error) {
+	props := []string{"name", "host", "configurationEx"}
+	pc := property.DefaultCollector(c.Client)
+	if ref.Type != "ClusterComputeResource" {
+		var cr mo.ComputeResource
+		if err := pc.RetrieveOne(ctx, ref, props, &cr); err != nil {
+			return nil, false, err
+		}
+		return &cr, false, nil
+	}
+
+	var cluster mo.ClusterComputeResource
+	if err := pc.RetrieveOne(ctx, ref, props, &cluster); err != nil {
+		return nil, false, err
+	}
+	drs := false
+	if info, ok := cluster.ConfigurationEx.(*types.ClusterConfigInfoEx); ok {
+		drs = info.DrsConfig.Enabled != nil && *info.DrsConfig.Enabled
+	}
+	return &cluster.ComputeResource, drs, nil
+}
+
+// hostUnusable says why the clone of vm cannot run on h, empty if it can.
+func (vm *virtualMachine) hostUnusable(ctx context.Context, h mo.HostSystem, ds *object.Datastore, networks []mo.Network, templateDatastores []types.ManagedObjectReference) string {
+	switch {
+	case h.Runtime.ConnectionState != types.HostSystemConnectionStateConnected:
+		return "is " + string(h.Runtime.ConnectionState)
+	case h.Runtime.InMaintenanceMode:
+		return "is in maintenance mode"
+	case !hasRef(h.Datastore, ds.Reference()):
+		return "does not see datastore " + datastoreName(ctx, ds)
+	}
+	for _, n := range networks {
+		if !hasRef(h.Network, n.Self) {
+			return "is not on network " + n.Name
+		}
+	}
+	for _, t := range templateDatastores {
+		if !hasRef(h.Datastore, t) {
+			return "does not see the template disks of a linked clone"
+		}
+	}
+	return ""
+}
+
+// hostLoad is the busier of the cpu and memory use of h, from 0 to 1,
+// counting placedMB of memory for clones not running yet.
+func hostLoad(h mo.HostSystem, placedMB int64) float64 {
+	hw, stats := h.Summary.Hardware, h.Summary.QuickStats
+	if hw == nil {
+		return 1
+	}
+	var cpu, mem float64
+	if mhz := float64(hw.CpuMhz) * float64(hw.NumCpuCores); mhz > 0 {
+		cpu = float64(stats.OverallCpuUsage) / mhz
+	}
+	if mb := float64(hw.MemorySize / 1024 / 1024); mb > 0 {
+		mem = float64(int64(stats.OverallMemoryUsage)+placedMB) / mb
+	}
+	if cpu > mem {
+		return cpu
+	}
+	return mem
+}
+
+func hasRef(refs []types.ManagedObjectReference, ref types.ManagedObjectReference) bool {
+	for _, r := range refs {
+		if r == ref {
+			return true
+		}
+	}
+	return false
+}
+
+// vmHostName returns the name of the host vmInst runs on.
+func vmHostName(ctx context.Context, vmInst *object.VirtualMachine) (string, error) {
+	var mvm mo.VirtualMachine
+	if err := vmInst.Properties(ctx, vmInst.Reference(), []string{"runtime.host"}, &mvm); err != nil {
+		return "", err
+	}
+	if mvm.Runtime.Host == nil {
+		return "", fmt.Errorf("vm %s has no host", vmInst.Reference().Value)
+	}
+	var mhost mo.HostSystem
+	host := object.NewHostSystem(vmInst.Client(), *mvm.Runtime.Host)
+	if err := host.Properties(ctx, host.Reference(), []string{"name"}, &mhost); err != nil {
+		return "", err
+	}
+	return mhost.Name, nil
+}
@@ -0,0 +1,75 @@
+package virtualmachine
+
+import (
+	"testing"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestHostLoad(t *testing.T) {
+	// 4 cores of 2000MHz and 16GB
+	host := func(cpuMhz, memMB int) mo.HostSystem {
+		var h mo.HostSystem
+		h.Summary.Hardware = &types.HostHardwareSummary{CpuMhz: 2000, NumCpuCores: 4, MemorySize: 16 << 30}
+		h.Summary.QuickStats = types.HostListSummaryQuickStats{OverallCpuUsage: cpuMhz, OverallMemoryUsage: memMB}
+		return h
+	}
+	tests := []struct {
+		name   string
+		host   mo.HostSystem
+		placed int64
+		want   float64
+	}{
+		{"idle", host(0, 0), 0, 0},
+		{"cpu bound", host(6000, 4096), 0, 0.75},
+		{"memory bound", host(2000, 8192), 0, 0.5},
+		{"placed clones count", host(2000, 8192), 4096, 0.75},
+		{"no hardware summary", mo.HostSystem{}, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hostLoad(tt.host, tt.placed); got != tt.want {
+				t.Errorf("load %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHasRef(t *testing.T) {
+	ds1 := types.ManagedObjectReference{Type: "Datastore", Value: "datastore-1"}
+	ds2 := types.ManagedObjectReference{Type: "Datastore", Value: "datastore-2"}
+	refs := []types.ManagedObjectReference{ds1}
+	if !hasRef(refs, ds1) || hasRef(refs, ds2) || hasRef(nil, ds1) {
+		t.Error("hasRef does not match references by type and value")
+	}
+}
+
+func TestPlacedMemoryRelease(t *testing.T) {
+	h1 := object.NewHostSystem(nil, types.ManagedObjectReference{Type: "HostSystem", Value: "host-1"})
+	m := newPlacedMemory()
+	m.mb["host-1"] = 6144
+
+	a := &placement{host: h1, placedMB: 4096}
+	m.release(a)
+	if m.mb["host-1"] != 2048 || a.placedMB != 0 {
+		t.Errorf("placed %v, placement still counts %d", m.mb, a.placedMB)
+	}
+	// released twice, by resolveAll and the worker
+	m.release(a)
+	if m.mb["host-1"] != 2048 {
+		t.Errorf("released twice, placed %v", m.mb)
+	}
+	// named hosts and drs count nothing
+	m.release(&placement{host: h1})
+	m.release(&placement{drs: "lab"})
+	m.release(nil)
+	if m.mb["host-1"] != 2048 {
+		t.Errorf("released memory never counted, placed %v", m.mb)
+	}
+	m.release(&placement{host: h1, placedMB: 2048})
+	if _, ok := m.mb["host-1"]; ok {
+		t.Errorf("empty host left in %v", m.mb)
+	}
+}
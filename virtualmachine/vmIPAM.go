@@ -0,0 +1,405 @@
+package virtualmachine
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/glide/msg"
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"golang.org/x/net/context"
+)
+
+// DefaultLeaseFile records the pool addresses handed out to vms.
+const DefaultLeaseFile = "leases.json"
+
+// ipPool is an ipv4 range nics take their address from.
+type ipPool struct {
+	name    string
+	network *net.IPNet
+	exclude [][2]uint32 // inclusive first, last
+	gateway string
+}
+
+// newIPPool parses the manifest pool s. Exclude entries are addresses or
+// first-last ranges.
+func newIPPool(name string, s poolSpec) (*ipPool, error) {
+	_, network, err := net.ParseCIDR(s.CIDR)
+	if err != nil || network.IP.To4() == nil {
+		return nil, fmt.Errorf("pool %s: cidr '%s' is not an ipv4 network/prefix", name, s.CIDR)
+	}
+	p := &ipPool{name: name, network: network, gateway: s.Gateway}
+
+	for _, e := range s.Exclude {
+		first, last := e, e
+		if i := strings.Index(e, "-"); i >= 0 {
+			first, last = strings.TrimSpace(e[:i]), strings.TrimSpace(e[i+1:])
+		}
+		a, b := net.ParseIP(first), net.ParseIP(last)
+		if a == nil || b == nil || a.To4() == nil || b.To4() == nil {
+			return nil, fmt.Errorf("pool %s: exclude '%s' is not an ipv4 address or range", name, e)
+		}
+		if !network.Contains(a) || !network.Contains(b) || ipToInt(a) > ipToInt(b) {
+			return nil, fmt.Errorf("pool %s: exclude '%s' is not a range inside %s", name, e, network)
+		}
+		p.exclude = append(p.exclude, [2]uint32{ipToInt(a), ipToInt(b)})
+	}
+
+	if s.Gateway != "" {
+		gw := net.ParseIP(s.Gateway)
+		if gw == nil || gw.To4() == nil || !network.Contains(gw) {
+			return nil, fmt.Errorf("pool %s: gateway '%s' is not an ipv4 address inside %s", name, s.Gateway, network)
+		}
+		// never hand out the gateway
+		p.exclude = append(p.exclude, [2]uint32{ipToInt(gw), ipToInt(gw)})
+	}
+	return p, nil
+}
+
+func (p *ipPool) prefix() int {
+	ones, _ := p.network.Mask.Size()
+	return ones
+}
+
+// addresses calls fn with every address of p that is not excluded, in
+// order, until fn returns true.
+func (p *ipPool) addresses(fn func(ip string) bool) {
+	first := ipToInt(p.network.IP)
+	last := first | ^binary.BigEndian.Uint32(net.IP(p.network.Mask).To4())
+	if p.prefix() <= 30 {
+		// network and broadcast address
+		first++
+		last--
+	}
+	for n := first; n <= last && n >= first; n++ {
+		if p.excluded(n) {
+			continue
+		}
+		if fn(intToIP(n).String()) {
+			return
+		}
+	}
+}
+
+func (p *ipPool) excluded(n uint32) bool {
+	for _, r := range p.exclude {
+		if n >= r[0] && n <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+func ipToInt(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func intToIP(n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+// lease is one pool address handed to a nic of a vm.
+type lease struct {
+	Pool string    `json:"pool"`
+	IP   string    `json:"ip"`
+	VM   string    `json:"vm"`
+	NIC  int       `json:"nic"`
+	Time time.Time `json:"time"`
+}
+
+// leaseFile is the local record of the leases. It is locked while open so
+// two runs never hand out the same address.
+type leaseFile struct {
+	path   string
+	locked bool
+	Leases []lease `json:"leases"`
+}
+
+// openLeases locks and reads the lease file at path, empty when it does not
+// exist yet. close releases the lock.
+func openLeases(path string) (*leaseFile, error) {
+	lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil, fmt.Errorf("Error lock leases: %s.lock exists, another run holds it or it is left from a crash", path)
+		}
+		return nil, fmt.Errorf("Error lock leases: %s", err)
+	}
+	lock.Close()
+
+	f, err := readLeases(path)
+	if err != nil {
+		os.Remove(path + ".lock")
+		return nil, err
+	}
+	f.locked = true
+	return f, nil
+}
+
+// readLeases reads the lease file at path without locking it, for a
+// preview that never saves. A run holding the lock may change it meanwhile.
+func readLeases(path string) (*leaseFile, error) {
+	f := &leaseFile{path: path}
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return f, nil
+	case err != nil:
+		return nil, fmt.Errorf("Error read leases: %s", err)
+	}
+	if err := json.Unmarshal(data, f); err != nil {
+		return nil, fmt.Errorf("Error parse leases %s: %s", path, err)
+	}
+	return f, nil
+}
+
+// close releases the lock of a file opened with openLeases.
+func (f *leaseFile) close() {
+	if f.locked {
+		os.Remove(f.path + ".lock")
+		f.locked = false
+	}
+}
+
+// save writes the leases through a temporary file so a crash never leaves
+// half a file behind.
+func (f *leaseFile) save() error {
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := f.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("Error write leases: %s", err)
+	}
+	if err := os.Rename(tmp, f.path); err != nil {
+		return fmt.Errorf("Error write leases: %s", err)
+	}
+	return nil
+}
+
+// find returns the index of the lease of nic of vm in pool, -1 if none.
+func (f *leaseFile) find(pool, vm string, nic int) int {
+	for i, l := range f.Leases {
+		if l.Pool == pool && l.VM == vm && l.NIC == nic {
+			return i
+		}
+	}
+	return -1
+}
+
+// leased reports whether ip is leased to any vm.
+func (f *leaseFile) leased(ip string) bool {
+	for _, l := range f.Leases {
+		if l.IP == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// release drops every lease of vm and returns how many there were.
+func (f *leaseFile) release(vm string) int {
+	kept := f.Leases[:0]
+	for _, l := range f.Leases {
+		if l.VM != vm {
+			kept = append(kept, l)
+		}
+	}
+	n := len(f.Leases) - len(kept)
+	f.Leases = kept
+	return n
+}
+
+// usesPools reports whether any nic of vms takes its address from a pool.
+func usesPools(vms []virtualMachine) bool {
+	for i := range vms {
+		for _, n := range vms[i].networkInterfaces {
+			if n.ipv4Pool != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// allocateAddresses gives every pool nic of vms its address: the one it
+// already leases, or the first one of the pool that is neither excluded,
+// leased nor reported by the guest of any vm in vCenter. Only running
+// guests with vmware tools report addresses, so a powered off vm that
+// was not leased here can still clash; exclude its address. The leases
+// are written back to path when save is set; without it the file is only
+// read, so a dry run works next to a running clone.
+func allocateAddresses(ctx context.Context, c *govmomi.Client, vms []virtualMachine, path string, save bool) error {
+	if !usesPools(vms) {
+		return nil
+	}
+	if path == "" {
+		path = DefaultLeaseFile
+	}
+	var f *leaseFile
+	var err error
+	if save {
+		f, err = openLeases(path)
+	} else {
+		f, err = readLeases(path)
+	}
+	if err != nil {
+		return err
+	}
+	defer f.close()
+
+	inUse, err := guestIPs(ctx, c)
+	if err != nil {
+		return newError(ErrUnknown, "", "list guest ips", err)
+	}
+
+	now := time.Now()
+	for i := range vms {
+		vm := &vms[i]
+		for j := range vm.networkInterfaces {
+			n := &vm.networkInterfaces[j]
+			if n.ipv4Pool == nil {
+				continue
+			}
+			p := n.ipv4Pool
+
+			if k := f.find(p.name, vm.name, j); k >= 0 {
+				ip := f.Leases[k].IP
+				if owner, ok := inUse[ip]; !ok || owner == vm.name {
+					n.setPoolAddress(p, ip)
+					continue
+				}
+				msg.Warn("vm %s: leased %s is used by %s, taking another address", vm.name, ip, inUse[ip])
+				f.Leases = append(f.Leases[:k], f.Leases[k+1:]...)
+			}
+
+			var ip string
+			p.addresses(func(candidate string) bool {
+				if _, ok := inUse[candidate]; ok || f.leased(candidate) {
+					return false
+				}
+				ip = candidate
+				return true
+			})
+			if ip == "" {
+				return newError(ErrInvalidSpec, vm.name, "allocate address", fmt.Errorf("pool %s has no free address", p.name))
+			}
+			n.setPoolAddress(p, ip)
+			f.Leases = append(f.Leases, lease{Pool: p.name, IP: ip, VM: vm.name, NIC: j, Time: now})
+			msg.Info("vm %s: networkInterfaces[%d] leases %s from pool %s", vm.name, j, ip, p.name)
+		}
+		if errs := vm.validateNetwork(); len(errs) > 0 {
+			return newError(ErrInvalidSpec, vm.name, "allocate address", errs[0])
+		}
+	}
+
+	if !save {
+		return nil
+	}
+	return f.save()
+}
+
+func (n *networkInterface) setPoolAddress(p *ipPool, ip string) {
+	n.ipv4Address = ip
+	n.ipv4PrefixLength = p.prefix()
+	if n.gateway == "" {
+		n.gateway = p.gateway
+	}
+}
+
+// releaseLeases drops the leases of the named vms from the lease file at
+// path, if there is one.
+func releaseLeases(path string, names []string) error {
+	if path == "" {
+		path = DefaultLeaseFile
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	f, err := openLeases(path)
+	if err != nil {
+		return err
+	}
+	defer f.close()
+
+	var released int
+	for _, name := range names {
+		released += f.release(name)
+	}
+	if released == 0 {
+		return nil
+	}
+	msg.Info("released %d leases", released)
+	return f.save()
+}
+
+// guestIPs maps every address the guests of all vms in vCenter report to
+// the name of the vm.
+func guestIPs(ctx context.Context, c *govmomi.Client) (map[string]string, error) {
+	// root folder -> datacenters -> vm folders -> vms
+	traverse := []types.BaseSelectionSpec{
+		&types.SelectionSpec{Name: "folder"},
+		&types.SelectionSpec{Name: "datacenter"},
+	}
+	req := types.RetrieveProperties{
+		SpecSet: []types.PropertyFilterSpec{{
+			ObjectSet: []types.ObjectSpec{{
+				Obj: c.ServiceContent.RootFolder,
+				SelectSet: []types.BaseSelectionSpec{
+					&types.TraversalSpec{
+						SelectionSpec: types.SelectionSpec{Name: "folder"},
+						Type:          "Folder",
+						Path:          "childEntity",
+						SelectSet:     traverse,
+					},
+					&types.TraversalSpec{
+						SelectionSpec: types.SelectionSpec{Name: "datacenter"},
+						Type:          "Datacenter",
+						Path:          "vmFolder",
+						SelectSet:     traverse,
+					},
+				},
+			}},
+			PropSet: []types.PropertySpec{{
+				Type:    "VirtualMachine",
+				PathSet: []string{"name", "guest.ipAddress", "guest.net"},
+			}},
+		}},
+	}
+
+	res, err := property.DefaultCollector(c.Client).RetrieveProperties(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	var mvms []mo.VirtualMachine
+	if err := mo.LoadRetrievePropertiesResponse(res, &mvms); err != nil {
+		return nil, err
+	}
+
+	ips := make(map[string]string)
+	for _, mvm := range mvms {
+		if mvm.Guest == nil {
+			continue
+		}
+		if mvm.Guest.IpAddress != "" {
+			ips[mvm.Guest.IpAddress] = mvm.Name
+		}
+		for _, nic := range mvm.Guest.Net {
+			for _, ip := range nic.IpAddress {
+				ips[ip] = mvm.Name
+			}
+		}
+	}
+	return ips, nil
+}
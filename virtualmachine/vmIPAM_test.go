@@ -0,0 +1,194 @@
+package virtualmachine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestNewIPPool(t *testing.T) {
+	tests := []struct {
+		name string
+		spec poolSpec
+		err  string
+	}{
+		{"plain", poolSpec{CIDR: "10.1.2.0/24"}, ""},
+		{"exclude and gateway", poolSpec{CIDR: "10.1.2.0/24", Gateway: "10.1.2.1", Exclude: []string{"10.1.2.5", "10.1.2.10 - 10.1.2.20"}}, ""},
+		{"no prefix", poolSpec{CIDR: "10.1.2.0"}, "is not an ipv4 network/prefix"},
+		{"ipv6", poolSpec{CIDR: "fd00::/64"}, "is not an ipv4 network/prefix"},
+		{"bad exclude", poolSpec{CIDR: "10.1.2.0/24", Exclude: []string{"10.1.2.x"}}, "is not an ipv4 address or range"},
+		{"exclude outside", poolSpec{CIDR: "10.1.2.0/24", Exclude: []string{"10.1.3.5"}}, "is not a range inside 10.1.2.0/24"},
+		{"exclude backwards", poolSpec{CIDR: "10.1.2.0/24", Exclude: []string{"10.1.2.20-10.1.2.10"}}, "is not a range inside"},
+		{"gateway outside", poolSpec{CIDR: "10.1.2.0/24", Gateway: "10.1.3.1"}, "gateway '10.1.3.1' is not an ipv4 address inside"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newIPPool("lab", tt.spec)
+			checkErr(t, err, tt.err)
+			if err == nil && (p.name != "lab" || p.gateway != tt.spec.Gateway || p.prefix() != 24) {
+				t.Errorf("got %+v", p)
+			}
+		})
+	}
+}
+
+func TestAddresses(t *testing.T) {
+	tests := []struct {
+		name string
+		spec poolSpec
+		stop int // addresses to take, 0 for all
+		want []string
+	}{
+		{"skips network and broadcast", poolSpec{CIDR: "10.1.2.0/29"}, 0, []string{"10.1.2.1", "10.1.2.2", "10.1.2.3", "10.1.2.4", "10.1.2.5", "10.1.2.6"}},
+		{"excludes", poolSpec{CIDR: "10.1.2.0/29", Gateway: "10.1.2.1", Exclude: []string{"10.1.2.3-10.1.2.5"}}, 0, []string{"10.1.2.2", "10.1.2.6"}},
+		{"point to point", poolSpec{CIDR: "10.1.2.0/31"}, 0, []string{"10.1.2.0", "10.1.2.1"}},
+		{"single address", poolSpec{CIDR: "10.1.2.7/32"}, 0, []string{"10.1.2.7"}},
+		{"top of the range", poolSpec{CIDR: "255.255.255.254/31"}, 0, []string{"255.255.255.254", "255.255.255.255"}},
+		{"stops", poolSpec{CIDR: "10.1.0.0/16"}, 2, []string{"10.1.0.1", "10.1.0.2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newIPPool("lab", tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			p.addresses(func(ip string) bool {
+				got = append(got, ip)
+				return len(got) == tt.stop
+			})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLeaseFile(t *testing.T) {
+	f := &leaseFile{Leases: []lease{
+		{Pool: "lab", IP: "10.1.2.1", VM: "web-001", NIC: 0},
+		{Pool: "lab", IP: "10.1.2.2", VM: "web-002", NIC: 0},
+		{Pool: "dmz", IP: "10.9.0.1", VM: "web-001", NIC: 1},
+	}}
+
+	tests := []struct {
+		pool, vm string
+		nic      int
+		want     int
+	}{
+		{"lab", "web-001", 0, 0},
+		{"dmz", "web-001", 1, 2},
+		{"lab", "web-001", 1, -1},
+		{"dmz", "web-002", 0, -1},
+	}
+	for _, tt := range tests {
+		if got := f.find(tt.pool, tt.vm, tt.nic); got != tt.want {
+			t.Errorf("find(%s, %s, %d) = %d, want %d", tt.pool, tt.vm, tt.nic, got, tt.want)
+		}
+	}
+	if !f.leased("10.9.0.1") || f.leased("10.1.2.3") {
+		t.Error("leased reports the wrong addresses")
+	}
+
+	if n := f.release("web-001"); n != 2 {
+		t.Errorf("released %d, want 2", n)
+	}
+	if n := f.release("web-001"); n != 0 {
+		t.Errorf("released %d again, want 0", n)
+	}
+	if len(f.Leases) != 1 || f.Leases[0].VM != "web-002" {
+		t.Errorf("left %+v", f.Leases)
+	}
+}
+
+func TestOpenLeases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "leases.json")
+
+	f, err := openLeases(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Leases) != 0 {
+		t.Errorf("new file has leases %+v", f.Leases)
+	}
+	if _, err := openLeases(path); err == nil {
+		t.Error("opened a locked file")
+	}
+	f.Leases = append(f.Leases, lease{Pool: "lab", IP: "10.1.2.1", VM: "web-001"})
+	if err := f.save(); err != nil {
+		t.Fatal(err)
+	}
+	f.close()
+
+	f, err = openLeases(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.find("lab", "web-001", 0) != 0 {
+		t.Errorf("saved leases lost, got %+v", f.Leases)
+	}
+	f.close()
+
+	if err := releaseLeases(path, []string{"web-001"}); err != nil {
+		t.Fatal(err)
+	}
+	f, err = openLeases(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.close()
+	if len(f.Leases) != 0 {
+		t.Errorf("released leases kept: %+v", f.Leases)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "bad.json"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = openLeases(filepath.Join(dir, "bad.json"))
+	checkErr(t, err, "Error parse leases")
+	if _, err := os.Stat(filepath.Join(dir, "bad.json.lock")); !os.IsNotExist(err) {
+		t.Error("lock left after a parse error")
+	}
+}
+
+func TestReadLeasesLocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "leases.json")
+
+	held, err := openLeases(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	held.Leases = append(held.Leases, lease{Pool: "lab", IP: "10.1.2.1", VM: "web-001"})
+	if err := held.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a dry run next to the run holding the lock
+	f, err := readLeases(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.leased("10.1.2.1") {
+		t.Errorf("leases %+v miss the held one", f.Leases)
+	}
+	f.close()
+	if _, err := os.Stat(path + ".lock"); err != nil {
+		t.Errorf("closing the preview dropped the lock of the run: %s", err)
+	}
+	held.close()
+	if _, err := os.Stat(path + ".lock"); !os.IsNotExist(err) {
+		t.Error("lock left after close")
+	}
+}
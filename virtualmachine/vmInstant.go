@@ -0,0 +1,226 @@
+package virtualmachine
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Masterminds/glide/msg"
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/task"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+	"golang.org/x/net/context"
+)
+
+// instantCloneAPI is the first vCenter API version with InstantClone_Task.
+var instantCloneAPI = [2]int{6, 7}
+
+// The vim bindings of this build predate InstantClone_Task, so its request
+// is declared here. Only concrete types are sent and the task result is a
+// vm reference, so nothing needs adding to the type registry.
+
+// instantCloneSpec is the InstantCloneSpec of the 6.7 API.
+type instantCloneSpec struct {
+	types.DynamicData
+
+	Name     string                  `xml:"name"`
+	Location instantCloneLocation    `xml:"location"`
+	Config   []types.BaseOptionValue `xml:"config,omitempty,typeattr"`
+}
+
+// instantCloneLocation is the part of VirtualMachineRelocateSpec an instant
+// clone takes, in the order of the schema; the bindings lack its
+// DeviceChange.
+type instantCloneLocation struct {
+	types.DynamicData
+
+	Folder       *types.ManagedObjectReference       `xml:"folder,omitempty"`
+	Datastore    *types.ManagedObjectReference       `xml:"datastore,omitempty"`
+	Pool         *types.ManagedObjectReference       `xml:"pool,omitempty"`
+	Host         *types.ManagedObjectReference       `xml:"host,omitempty"`
+	DeviceChange []types.BaseVirtualDeviceConfigSpec `xml:"deviceChange,omitempty,typeattr"`
+}
+
+type instantCloneRequest struct {
+	This types.ManagedObjectReference `xml:"_this"`
+	Spec instantCloneSpec             `xml:"spec"`
+}
+
+type instantCloneResponse struct {
+	Returnval types.ManagedObjectReference `xml:"returnval"`
+}
+
+type instantCloneBody struct {
+	Req    *instantCloneRequest  `xml:"urn:vim25 InstantClone_Task,omitempty"`
+	Res    *instantCloneResponse `xml:"urn:vim25 InstantClone_TaskResponse,omitempty"`
+	Fault_ *soap.Fault           `xml:"http://schemas.xmlsoap.org/soap/envelope/ Fault,omitempty"`
+}
+
+func (b *instantCloneBody) Fault() *soap.Fault { return b.Fault_ }
+
+// instantFallback checks the source of an instant clone of vm and returns
+// why it is made as a linked clone of the source snapshot instead, empty
+// when vCenter has instant clones. An instant clone forks the running
+// source, so the source must be powered on whatever the clone becomes.
+func (vm *virtualMachine) instantFallback(ctx context.Context, c *govmomi.Client, source *object.VirtualMachine) (string, error) {
+	var mvm mo.VirtualMachine
+	if err := source.Properties(ctx, source.Reference(), []string{"runtime.powerState"}, &mvm); err != nil {
+		return "", err
+	}
+	if mvm.Runtime.PowerState != types.VirtualMachinePowerStatePoweredOn {
+		return "", fmt.Errorf("instant clones fork a running vm, %s is %s", vm.template, mvm.Runtime.PowerState)
+	}
+
+	version := c.ServiceContent.About.ApiVersion
+	if !apiAtLeast(version, instantCloneAPI) {
+		return fmt.Sprintf("vCenter api %s has no instant clone, it came with %d.%d", version, instantCloneAPI[0], instantCloneAPI[1]), nil
+	}
+	return "", nil
+}
+
+// instantUnsupported says why the clone of vm at p cannot be forked even
+// where vCenter has instant clones, empty if it can. A fork keeps the
+// nics of the source and skips the guest customization.
+func (vm *virtualMachine) instantUnsupported(p *placement) string {
+	switch {
+	case isWindowsGuest(p.guestID):
+		return "windows guests need the sysprep an instant clone skips"
+	case vm.specName() != "":
+		return "an instant clone skips the customization spec"
+	case len(vm.staticIPs()) > 0 && len(vm.postCommands) == 0:
+		// the fork would keep the addresses of the source
+		return "no postCommands apply the guestinfo addresses to a fork"
+	}
+	for _, d := range p.networkDevices {
+		if d.GetVirtualDeviceConfigSpec().Operation != types.VirtualDeviceConfigSpecOperationEdit {
+			return "an instant clone only moves the nics of the source to other networks, it cannot add or remove any"
+		}
+	}
+	return ""
+}
+
+// deployInstant starts the instant clone of vm at p: a fork of the running
+// template that shares its memory and disks. The guest keeps the identity
+// of the source; the new one is handed over as guestinfo variables for the
+// post commands to apply.
+func (vm *virtualMachine) deployInstant(ctx context.Context, c *govmomi.Client, p *placement) (*object.Task, error) {
+	if vm.vcpu != 0 || vm.memoryMb != 0 {
+		msg.Warn("vm %s: an instant clone keeps the cpus and memory of %s", vm.name, vm.template)
+	}
+	folder := p.folder.Reference()
+	req := instantCloneRequest{
+		This: p.template.Reference(),
+		Spec: instantCloneSpec{
+			Name: vm.name,
+			Location: instantCloneLocation{
+				Folder:       &folder,
+				Datastore:    p.relocateSpec.Datastore,
+				Pool:         p.relocateSpec.Pool,
+				Host:         p.relocateSpec.Host,
+				DeviceChange: p.networkDevices,
+			},
+			Config: vm.guestInfo(),
+		},
+	}
+
+	reqBody, resBody := instantCloneBody{Req: &req}, instantCloneBody{}
+	if err := apiRoundTripper(c).RoundTrip(ctx, &reqBody, &resBody); err != nil {
+		return nil, err
+	}
+	if resBody.Res == nil {
+		return nil, fmt.Errorf("InstantClone_Task returned no task")
+	}
+	return object.NewTask(c.Client, resBody.Res.Returnval), nil
+}
+
+// guestInfo is the extra config of the instant clone of vm: its
+// customConfigurations and the guest identity as guestinfo variables,
+// guestinfo.hostname, guestinfo.domain, guestinfo.dns and per nic i
+// guestinfo.nic<i>.ipv4, .gateway, .ipv6 and .ipv6Gateway.
+func (vm *virtualMachine) guestInfo() []types.BaseOptionValue {
+	var ov []types.BaseOptionValue
+	set := func(key string, value types.AnyType) {
+		ov = append(ov, &types.OptionValue{Key: key, Value: value})
+	}
+	for k, v := range vm.customConfigurations {
+		set(k, v)
+	}
+
+	set("guestinfo.hostname", vm.hostName())
+	if vm.domain != "" {
+		set("guestinfo.domain", vm.domain)
+	}
+	if len(vm.dnsServers) > 0 {
+		set("guestinfo.dns", strings.Join(vm.dnsServers, ","))
+	}
+	for i, n := range vm.networkInterfaces {
+		key := fmt.Sprintf("guestinfo.nic%d.", i)
+		if n.ipv4Address != "" {
+			set(key+"ipv4", fmt.Sprintf("%s/%d", n.ipv4Address, n.ipv4PrefixLength))
+			if gw := vm.nicGateway(n); gw != "" {
+				set(key+"gateway", gw)
+			}
+		}
+		if n.ipv6Address != "" {
+			set(key+"ipv6", fmt.Sprintf("%s/%d", n.ipv6Address, n.ipv6PrefixLength))
+			if gw := vm.nicIPv6Gateway(n); gw != "" {
+				set(key+"ipv6Gateway", gw)
+			}
+		}
+	}
+	return ov
+}
+
+// apiRoundTripper returns the soap client of c speaking the api version of
+// vCenter instead of the one of the bindings, which has no
+// InstantClone_Task. The copy shares the session of c.
+func apiRoundTripper(c *govmomi.Client) soap.RoundTripper {
+	if c.Client.Client == nil {
+		return c.Client
+	}
+	sc := *c.Client.Client
+	sc.Version = c.ServiceContent.About.ApiVersion
+	return &sc
+}
+
+// isNotSupported reports whether err is the NotSupported fault vCenter
+// answers an instant clone it cannot make with.
+func isNotSupported(err error) bool {
+	var fault interface{}
+	switch e := err.(type) {
+	case task.Error:
+		fault = e.Fault()
+	default:
+		if soap.IsSoapFault(err) {
+			fault = soap.ToSoapFault(err).VimFault()
+		} else if soap.IsVimFault(err) {
+			fault = soap.ToVimFault(err)
+		}
+	}
+	switch fault.(type) {
+	case types.NotSupported, *types.NotSupported:
+		return true
+	}
+	return false
+}
+
+// apiAtLeast reports whether the api version string, like 6.7.1, is at
+// least major.minor.
+func apiAtLeast(version string, want [2]int) bool {
+	parts := strings.SplitN(version, ".", 3)
+	var got [2]int
+	for i := 0; i < 2 && i < len(parts); i++ {
+		n, err := strconv.Atoi(parts[i])
+		if err != nil {
+			return false
+		}
+		got[i] = n
+	}
+	if got[0] != want[0] {
+		return got[0] > want[0]
+	}
+	return got[1] >= want[1]
+}
@@ -0,0 +1,175 @@
+package virtualmachine
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/vmware/govmomi/task"
+	"github.com/vmware/govmomi/vim25/types"
+	"github.com/vmware/govmomi/vim25/xml"
+)
+
+func TestAPIAtLeast(t *testing.T) {
+	tests := []struct {
+		version string
+		want    bool
+	}{
+		{"6.7", true},
+		{"6.7.1", true},
+		{"6.7.3.0", true},
+		{"7.0", true},
+		{"6.8", true},
+		{"6.5", false},
+		{"6.0", false},
+		{"5.5", false},
+		{"6", false},
+		{"", false},
+		{"six.seven", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			if got := apiAtLeast(tt.version, instantCloneAPI); got != tt.want {
+				t.Errorf("apiAtLeast(%q) = %v, want %v", tt.version, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInstantUnsupported(t *testing.T) {
+	edit := &types.VirtualDeviceConfigSpec{Operation: types.VirtualDeviceConfigSpecOperationEdit}
+	add := &types.VirtualDeviceConfigSpec{Operation: types.VirtualDeviceConfigSpecOperationAdd}
+	tests := []struct {
+		name    string
+		guestID string
+		spec    map[string]types.AnyType
+		static  bool
+		changes []types.BaseVirtualDeviceConfigSpec
+		want    string
+	}{
+		{"linux", "centos64Guest", nil, false, nil, ""},
+		{"nics moved", "centos64Guest", nil, false, []types.BaseVirtualDeviceConfigSpec{edit}, ""},
+		{"nics added", "centos64Guest", nil, false, []types.BaseVirtualDeviceConfigSpec{edit, add}, "cannot add or remove"},
+		{"windows", "windows9Server64Guest", nil, false, nil, "sysprep"},
+		{"named spec", "centos64Guest", map[string]types.AnyType{"name": "linux"}, false, nil, "customization spec"},
+		{"static address without commands", "centos64Guest", nil, true, nil, "no postCommands"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := &virtualMachine{name: "vm", customizationSpecification: tt.spec}
+			if tt.static {
+				vm.networkInterfaces = []networkInterface{{ipv4Address: "10.10.10.21", ipv4PrefixLength: 24}}
+			}
+			got := vm.instantUnsupported(&placement{guestID: tt.guestID, networkDevices: tt.changes})
+			if (got == "") != (tt.want == "") || !strings.Contains(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGuestInfo(t *testing.T) {
+	vm := &virtualMachine{
+		name:                 "worker-001.lab",
+		domain:               "lab.local",
+		gateway:              "10.10.10.1",
+		dnsServers:           []string{"10.10.10.2", "10.10.10.3"},
+		customConfigurations: map[string]types.AnyType{"guestinfo.role": "worker"},
+		networkInterfaces: []networkInterface{
+			{ipv4Address: "10.10.10.21", ipv4PrefixLength: 24},
+			{ipv6Address: "fd00::21", ipv6PrefixLength: 64, ipv6Gateway: "fd00::1"},
+			{},
+		},
+	}
+	want := map[string]string{
+		"guestinfo.role":             "worker",
+		"guestinfo.hostname":         "worker-001",
+		"guestinfo.domain":           "lab.local",
+		"guestinfo.dns":              "10.10.10.2,10.10.10.3",
+		"guestinfo.nic0.ipv4":        "10.10.10.21/24",
+		"guestinfo.nic0.gateway":     "10.10.10.1",
+		"guestinfo.nic1.ipv6":        "fd00::21/64",
+		"guestinfo.nic1.ipv6Gateway": "fd00::1",
+	}
+
+	got := make(map[string]string)
+	for _, o := range vm.guestInfo() {
+		v := o.GetOptionValue()
+		got[v.Key], _ = v.Value.(string)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %q, want %q", k, got[k], v)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestIsNotSupported(t *testing.T) {
+	fault := func(f types.BaseMethodFault) error {
+		return task.Error{LocalizedMethodFault: &types.LocalizedMethodFault{Fault: f}}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"not supported", fault(&types.NotSupported{}), true},
+		{"other fault", fault(&types.InvalidState{}), false},
+		{"plain error", errors.New("NotSupported"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isNotSupported(tt.err); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInstantCloneRequest(t *testing.T) {
+	ref := func(kind, value string) *types.ManagedObjectReference {
+		return &types.ManagedObjectReference{Type: kind, Value: value}
+	}
+	body := instantCloneBody{Req: &instantCloneRequest{
+		This: *ref("VirtualMachine", "vm-1"),
+		Spec: instantCloneSpec{
+			Name: "worker-001",
+			Location: instantCloneLocation{
+				Folder: ref("Folder", "group-v3"),
+				Pool:   ref("ResourcePool", "resgroup-8"),
+				DeviceChange: []types.BaseVirtualDeviceConfigSpec{
+					&types.VirtualDeviceConfigSpec{Operation: types.VirtualDeviceConfigSpecOperationEdit},
+				},
+			},
+			Config: []types.BaseOptionValue{&types.OptionValue{Key: "guestinfo.hostname", Value: "worker-001"}},
+		},
+	}}
+	b, err := xml.Marshal(&body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(b)
+
+	// the schema orders the elements
+	order := []string{`<InstantClone_Task xmlns="urn:vim25">`, `<_this type="VirtualMachine">vm-1</_this>`,
+		`<name>worker-001</name>`, `<location>`, `<folder type="Folder">group-v3</folder>`,
+		`<pool type="ResourcePool">resgroup-8</pool>`, `type="VirtualDeviceConfigSpec"><operation>edit</operation></deviceChange>`,
+		`</location>`, `type="OptionValue"><key>guestinfo.hostname</key>`}
+	last := -1
+	for _, s := range order {
+		i := strings.Index(got, s)
+		if i < 0 {
+			t.Fatalf("%s missing from %s", s, got)
+		}
+		if i < last {
+			t.Errorf("%s out of order in %s", s, got)
+		}
+		last = i
+	}
+	if strings.Contains(got, "<datastore") || strings.Contains(got, "<host") {
+		t.Errorf("unset references sent: %s", got)
+	}
+}
@@ -0,0 +1,132 @@
+package virtualmachine
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/Masterminds/glide/msg"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"golang.org/x/net/context"
+)
+
+// snapshotMu keeps parallel clones from creating the same template
+// snapshot twice.
+var snapshotMu sync.Mutex
+
+// linkedSnapshot returns the template snapshot the linked disks of vm are
+// children of: the one named vm.snapshot, or the current one when no name
+// is given. A named snapshot that does not exist yet is returned as nil
+// with create set; resolve changes nothing, deploy creates it.
+func (vm *virtualMachine) linkedSnapshot(ctx context.Context, template *object.VirtualMachine) (ref *types.ManagedObjectReference, create bool, err error) {
+	var mvm mo.VirtualMachine
+	if err := template.Properties(ctx, template.Reference(), []string{"snapshot", "config.template"}, &mvm); err != nil {
+		return nil, false, err
+	}
+
+	if vm.snapshot == "" {
+		if mvm.Snapshot == nil || mvm.Snapshot.CurrentSnapshot == nil {
+			return nil, false, fmt.Errorf("linked clones need a snapshot of %s, it has none; set snapshot to a name to create one", vm.template)
+		}
+		return mvm.Snapshot.CurrentSnapshot, false, nil
+	}
+
+	if mvm.Snapshot != nil {
+		ref, err := findSnapshot(mvm.Snapshot.RootSnapshotList, vm.snapshot)
+		if err != nil || ref != nil {
+			return ref, false, err
+		}
+	}
+	if mvm.Config != nil && mvm.Config.Template {
+		return nil, false, fmt.Errorf("%s has no snapshot %s and is marked as a template, which cannot take snapshots; create it on the vm before marking it", vm.template, vm.snapshot)
+	}
+	return nil, true, nil
+}
+
+// needsSnapshot reports whether the clone of vm at p puts disks on a
+// template snapshot. An instant clone forks the running template and needs
+// none, unless it falls back to a linked clone.
+func (vm *virtualMachine) needsSnapshot(p *placement) bool {
+	if vm.instant && p.fallback == "" {
+		return false
+	}
+	return vm.hasLinkedDisks()
+}
+
+// findSnapshot returns the snapshot called name in trees, nil if there is
+// none.
+func findSnapshot(trees []types.VirtualMachineSnapshotTree, name string) (*types.ManagedObjectReference, error) {
+	var found []types.ManagedObjectReference
+	var walk func(trees []types.VirtualMachineSnapshotTree)
+	walk = func(trees []types.VirtualMachineSnapshotTree) {
+		for _, t := range trees {
+			if t.Name == name {
+				found = append(found, t.Snapshot)
+			}
+			walk(t.ChildSnapshotList)
+		}
+	}
+	walk(trees)
+
+	switch len(found) {
+	case 0:
+		return nil, nil
+	case 1:
+		return &found[0], nil
+	}
+	return nil, fmt.Errorf("%d snapshots are called %s, rename all but one", len(found), name)
+}
+
+// createLinkedSnapshot takes the snapshot vm.snapshot of template unless a
+// parallel clone did so first, and returns it.
+func (vm *virtualMachine) createLinkedSnapshot(ctx context.Context, template *object.VirtualMachine) (*types.ManagedObjectReference, error) {
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+
+	ref, create, err := vm.linkedSnapshot(ctx, template)
+	if err != nil || !create {
+		return ref, err
+	}
+
+	msg.Info("vm %s: create snapshot %s of %s for linked clones", vm.name, vm.snapshot, vm.template)
+	task, err := template.CreateSnapshot(ctx, vm.snapshot, "base of linked clones", false, false)
+	if err != nil {
+		return nil, err
+	}
+	info, err := waitTask(ctx, task)
+	if err != nil {
+		return nil, err
+	}
+	snapshot, ok := info.Result.(types.ManagedObjectReference)
+	if !ok {
+		return nil, fmt.Errorf("snapshot task of %s returned %T instead of the snapshot", vm.template, info.Result)
+	}
+	return &snapshot, nil
+}
+
+// checkLinkedDatastores makes sure host sees every datastore holding a
+// template disk: the child disks of a linked clone keep reading their
+// parents there, wherever the clone itself is placed.
+func checkLinkedDatastores(ctx context.Context, template *object.VirtualMachine, host *object.HostSystem) error {
+	var mvm mo.VirtualMachine
+	if err := template.Properties(ctx, template.Reference(), []string{"datastore"}, &mvm); err != nil {
+		return err
+	}
+	var mhost mo.HostSystem
+	if err := host.Properties(ctx, host.Reference(), []string{"datastore"}, &mhost); err != nil {
+		return err
+	}
+
+	seen := make(map[types.ManagedObjectReference]bool)
+	for _, ds := range mhost.Datastore {
+		seen[ds] = true
+	}
+	for _, ds := range mvm.Datastore {
+		if !seen[ds] {
+			name := datastoreName(ctx, object.NewDatastore(template.Client(), ds))
+			return fmt.Errorf("host %s does not see datastore %s of the template disks, a linked clone cannot read its parent disks there", host.InventoryPath, name)
+		}
+	}
+	return nil
+}
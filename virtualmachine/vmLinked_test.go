@@ -0,0 +1,71 @@
+package virtualmachine
+
+import (
+	"testing"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// snapshotTree returns a snapshot called name with ref value and children.
+func snapshotTree(name, value string, children ...types.VirtualMachineSnapshotTree) types.VirtualMachineSnapshotTree {
+	return types.VirtualMachineSnapshotTree{
+		Name:              name,
+		Snapshot:          types.ManagedObjectReference{Type: "VirtualMachineSnapshot", Value: value},
+		ChildSnapshotList: children,
+	}
+}
+
+func TestFindSnapshot(t *testing.T) {
+	trees := []types.VirtualMachineSnapshotTree{
+		snapshotTree("base", "snapshot-1",
+			snapshotTree("linked-base", "snapshot-2"),
+			snapshotTree("patched", "snapshot-3", snapshotTree("twice", "snapshot-4"))),
+		snapshotTree("twice", "snapshot-5"),
+	}
+	tests := []struct {
+		name  string
+		find  string
+		value string // of the ref found, empty for none
+		want  string
+	}{
+		{"root", "base", "snapshot-1", ""},
+		{"child", "linked-base", "snapshot-2", ""},
+		{"missing", "gone", "", ""},
+		{"ambiguous", "twice", "", "2 snapshots are called twice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ref, err := findSnapshot(trees, tt.find)
+			checkErr(t, err, tt.want)
+			value := ""
+			if ref != nil {
+				value = ref.Value
+			}
+			if value != tt.value {
+				t.Errorf("snapshot %q, want %q", value, tt.value)
+			}
+		})
+	}
+}
+
+func TestNeedsSnapshot(t *testing.T) {
+	tests := []struct {
+		name     string
+		vm       virtualMachine
+		fallback string
+		want     bool
+	}{
+		{"full", virtualMachine{hardDisks: []hardDisk{{}}}, "", false},
+		{"linked", virtualMachine{linked: true}, "", true},
+		{"linked disk", virtualMachine{hardDisks: []hardDisk{{initType: initLinked}}}, "", true},
+		{"instant", virtualMachine{instant: true}, "", false},
+		{"instant falling back", virtualMachine{instant: true}, "windows guests need the sysprep an instant clone skips", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.vm.needsSnapshot(&placement{fallback: tt.fallback}); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,607 @@
+package virtualmachine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/vmware/govmomi/vim25/types"
+	"gopkg.in/yaml.v2"
+)
+
+// nicSpec is the manifest form of networkInterface.
+type nicSpec struct {
+	DeviceName       string `yaml:"deviceName" json:"deviceName"`
+	Label            string `yaml:"label" json:"label"`
+	IPv4Address      string `yaml:"ipv4Address" json:"ipv4Address"`
+	IPv4Pool         string `yaml:"ipv4Pool" json:"ipv4Pool"` // takes ipv4Address from a pool
+	IPv4PrefixLength int    `yaml:"ipv4PrefixLength" json:"ipv4PrefixLength"`
+	IPv6Address      string `yaml:"ipv6Address" json:"ipv6Address"`
+	IPv6PrefixLength int    `yaml:"ipv6PrefixLength" json:"ipv6PrefixLength"`
+	IPv6Mode         string `yaml:"ipv6Mode" json:"ipv6Mode"`
+	AdapterType      string `yaml:"adapterType" json:"adapterType"`
+	MacAddress       string `yaml:"macAddress" json:"macAddress"`
+	WakeOnLan        *bool  `yaml:"wakeOnLan" json:"wakeOnLan"`
+	StartConnected   *bool  `yaml:"startConnected" json:"startConnected"`
+	// Gateway and IPv6Gateway override the vm gateways for this nic
+	Gateway     string      `yaml:"gateway" json:"gateway"`
+	IPv6Gateway string      `yaml:"ipv6Gateway" json:"ipv6Gateway"`
+	Routes      []routeSpec `yaml:"routes" json:"routes"`
+}
+
+// poolSpec is the manifest form of ipPool.
+type poolSpec struct {
+	CIDR    string   `yaml:"cidr" json:"cidr"`
+	Exclude []string `yaml:"exclude" json:"exclude"`
+	Gateway string   `yaml:"gateway" json:"gateway"`
+}
+
+// routeSpec is the manifest form of staticRoute.
+type routeSpec struct {
+	To  string `yaml:"to" json:"to"`
+	Via string `yaml:"via" json:"via"`
+}
+
+// diskSpec is the manifest form of hardDisk.
+type diskSpec struct {
+	Size       int64  `yaml:"size" json:"size"`
+	IOPS       int64  `yaml:"iops" json:"iops"`
+	InitType   string `yaml:"initType" json:"initType"`
+	Datastore  string `yaml:"datastore" json:"datastore"`
+	Controller string `yaml:"controller" json:"controller"`
+	UnitNumber *int   `yaml:"unitNumber" json:"unitNumber"`
+	DiskMode   string `yaml:"diskMode" json:"diskMode"`
+}
+
+// windowsSpec is the manifest form of windowsOptions.
+type windowsSpec struct {
+	AdminPassword  string   `yaml:"adminPassword" json:"adminPassword"`
+	FullName       string   `yaml:"fullName" json:"fullName"`
+	OrgName        string   `yaml:"orgName" json:"orgName"`
+	ProductKey     string   `yaml:"productKey" json:"productKey"`
+	Workgroup      string   `yaml:"workgroup" json:"workgroup"`
+	JoinDomain     string   `yaml:"joinDomain" json:"joinDomain"`
+	DomainUser     string   `yaml:"domainUser" json:"domainUser"`
+	DomainPassword string   `yaml:"domainPassword" json:"domainPassword"`
+	AutoLogonCount int      `yaml:"autoLogonCount" json:"autoLogonCount"`
+	RunOnce        []string `yaml:"runOnce" json:"runOnce"`
+}
+
+// vmSpec is the manifest form of virtualMachine. It is used both for the
+// defaults block and for every vm entry.
+type vmSpec struct {
+	Name string `yaml:"name" json:"name"`
+	// Count stamps out that many vms of the entry, see expandName
+	Count int `yaml:"count" json:"count"`
+	// HostName is the guest host name, derived from Name when empty
+	HostName          string     `yaml:"hostName" json:"hostName"`
+	Folder            string     `yaml:"folder" json:"folder"`
+	Datacenter        string     `yaml:"datacenter" json:"datacenter"`
+	Cluster           string     `yaml:"cluster" json:"cluster"`
+	ResourcePool      string     `yaml:"resourcePool" json:"resourcePool"`
+	Datastore         string     `yaml:"datastore" json:"datastore"`
+	Host              string     `yaml:"host" json:"host"`
+	Template          string     `yaml:"template" json:"template"`
+	VCPU              int        `yaml:"vcpu" json:"vcpu"`
+	MemoryMb          int64      `yaml:"memoryMb" json:"memoryMb"`
+	NetworkInterfaces []nicSpec  `yaml:"networkInterfaces" json:"networkInterfaces"`
+	NICPolicy         string     `yaml:"nicPolicy" json:"nicPolicy"`
+	HardDisks         []diskSpec `yaml:"hardDisks" json:"hardDisks"`
+	// Linked clones every template disk, whatever its initType, as a
+	// child of the template Snapshot, created when it does not exist.
+	// Instant forks the running template instead, and falls back to a
+	// linked clone where vCenter lacks or refuses instant clones. The fork
+	// keeps the guest network of the template; its own is only set as
+	// guestinfo variables, for the PostCommands to apply
+	Linked               *bool             `yaml:"linked" json:"linked"`
+	Instant              *bool             `yaml:"instant" json:"instant"`
+	Snapshot             string            `yaml:"snapshot" json:"snapshot"`
+	Gateway              string            `yaml:"gateway" json:"gateway"`
+	IPv6Gateway          string            `yaml:"ipv6Gateway" json:"ipv6Gateway"`
+	Domain               string            `yaml:"domain" json:"domain"`
+	TimeZone             string            `yaml:"timeZone" json:"timeZone"`
+	DNSSuffixes          []string          `yaml:"dnsSuffixes" json:"dnsSuffixes"`
+	DNSServers           []string          `yaml:"dnsServers" json:"dnsServers"`
+	CustomConfigurations map[string]string `yaml:"customConfigurations" json:"customConfigurations"`
+	// CustomizationSpec names a vCenter customization spec to start from
+	CustomizationSpec string `yaml:"customizationSpec" json:"customizationSpec"`
+	// Windows sets the sysprep identity of Windows guests
+	Windows windowsSpec `yaml:"windows" json:"windows"`
+	// PostCommands run in the guest once it is up, through Shell
+	PostCommands []string `yaml:"postCommands" json:"postCommands"`
+	Shell        string   `yaml:"shell" json:"shell"`
+}
+
+// manifest is the declarative vm spec file: a defaults block merged under
+// every entry of vms.
+type manifest struct {
+	Pools    map[string]poolSpec `yaml:"pools" json:"pools"`
+	Defaults vmSpec              `yaml:"defaults" json:"defaults"`
+	VMs      []vmSpec            `yaml:"vms" json:"vms"`
+}
+
+// isManifest reports whether path is a structured manifest rather than a
+// legacy space separated vmlist.
+func isManifest(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml", ".json":
+		return true
+	}
+	return false
+}
+
+// loadManifest reads a YAML or JSON manifest into vm objects.
+func loadManifest(path string) ([]virtualMachine, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var m manifest
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&m)
+	} else {
+		err = yaml.UnmarshalStrict(data, &m)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error parse manifest %s: %s", path, err)
+	}
+	if len(m.VMs) == 0 {
+		return nil, fmt.Errorf("Error manifest %s: no vms declared", path)
+	}
+
+	pools := make(map[string]*ipPool)
+	for name, ps := range m.Pools {
+		p, err := newIPPool(name, ps)
+		if err != nil {
+			return nil, fmt.Errorf("Error manifest %s: %s", path, err)
+		}
+		pools[name] = p
+	}
+
+	vms := make([]virtualMachine, 0, len(m.VMs))
+	seen := make(map[string]int)
+	for i, entry := range m.VMs {
+		copies, err := entryVMs(mergeSpec(m.Defaults, entry), pools)
+		if err != nil {
+			return nil, fmt.Errorf("Error manifest %s: vms[%d] (%s): %s", path, i, entry.Name, err)
+		}
+		for _, vm := range copies {
+			if j, ok := seen[vm.Path()]; ok {
+				return nil, fmt.Errorf("Error manifest %s: vms[%d] (%s): %s is also declared by vms[%d]", path, i, entry.Name, vm.Path(), j)
+			}
+			seen[vm.Path()] = i
+			vms = append(vms, vm)
+		}
+	}
+	return vms, nil
+}
+
+// entryVMs checks the merged manifest entry spec and stamps out its vms,
+// count of them when set, with the name patterns expanded.
+func entryVMs(spec vmSpec, pools map[string]*ipPool) ([]virtualMachine, error) {
+	if err := spec.splitCIDRs(); err != nil {
+		return nil, err
+	}
+	if err := spec.validate(); err != nil {
+		return nil, err
+	}
+
+	count := spec.Count
+	if count == 0 {
+		count = 1
+	}
+	vms := make([]virtualMachine, 0, count)
+	for index := 1; index <= count; index++ {
+		c := spec
+		var err error
+		if c.Name, err = spec.expandName(spec.Name, index, ""); err != nil {
+			return nil, fmt.Errorf("name: %s", err)
+		}
+		if c.HostName, err = spec.expandName(spec.HostName, index, c.Name); err != nil {
+			return nil, fmt.Errorf("hostName: %s", err)
+		}
+
+		vm := c.virtualMachine()
+		for j, n := range spec.NetworkInterfaces {
+			if n.IPv4Pool == "" {
+				continue
+			}
+			p, ok := pools[n.IPv4Pool]
+			if !ok {
+				return nil, fmt.Errorf("networkInterfaces[%d]: unknown ipv4Pool '%s'", j, n.IPv4Pool)
+			}
+			if n.IPv4PrefixLength != 0 && n.IPv4PrefixLength != p.prefix() {
+				return nil, fmt.Errorf("networkInterfaces[%d]: ipv4PrefixLength %d conflicts with pool %s", j, n.IPv4PrefixLength, p.network)
+			}
+			vm.networkInterfaces[j].ipv4Pool = p
+		}
+		if errs := vm.validateNetwork(); len(errs) > 0 {
+			return nil, errs[0]
+		}
+		vms = append(vms, vm)
+	}
+	return vms, nil
+}
+
+// mergeSpec returns base overridden by every field set in over. NICs and
+// disks are merged by position so an entry can set only what differs.
+func mergeSpec(base, over vmSpec) vmSpec {
+	s := base
+	setString(&s.Name, over.Name)
+	if over.Count != 0 {
+		s.Count = over.Count
+	}
+	setString(&s.HostName, over.HostName)
+	setString(&s.Folder, over.Folder)
+	setString(&s.Datacenter, over.Datacenter)
+	setString(&s.Cluster, over.Cluster)
+	setString(&s.ResourcePool, over.ResourcePool)
+	setString(&s.Datastore, over.Datastore)
+	setString(&s.Host, over.Host)
+	setString(&s.Template, over.Template)
+	setString(&s.NICPolicy, over.NICPolicy)
+	setString(&s.CustomizationSpec, over.CustomizationSpec)
+	s.Windows = mergeWindows(base.Windows, over.Windows)
+	if over.PostCommands != nil {
+		s.PostCommands = over.PostCommands
+	}
+	setString(&s.Shell, over.Shell)
+	if over.VCPU != 0 {
+		s.VCPU = over.VCPU
+	}
+	if over.MemoryMb != 0 {
+		s.MemoryMb = over.MemoryMb
+	}
+	setString(&s.Gateway, over.Gateway)
+	setString(&s.IPv6Gateway, over.IPv6Gateway)
+	setString(&s.Domain, over.Domain)
+	setString(&s.TimeZone, over.TimeZone)
+	if over.DNSSuffixes != nil {
+		s.DNSSuffixes = over.DNSSuffixes
+	}
+	if over.DNSServers != nil {
+		s.DNSServers = over.DNSServers
+	}
+
+	s.NetworkInterfaces = nil
+	for i := 0; i < len(base.NetworkInterfaces) || i < len(over.NetworkInterfaces); i++ {
+		var n nicSpec
+		if i < len(base.NetworkInterfaces) {
+			n = base.NetworkInterfaces[i]
+		}
+		if i < len(over.NetworkInterfaces) {
+			n = mergeNIC(n, over.NetworkInterfaces[i])
+		}
+		s.NetworkInterfaces = append(s.NetworkInterfaces, n)
+	}
+
+	if over.Linked != nil {
+		s.Linked = over.Linked
+	}
+	if over.Instant != nil {
+		s.Instant = over.Instant
+	}
+	setString(&s.Snapshot, over.Snapshot)
+
+	s.HardDisks = nil
+	for i := 0; i < len(base.HardDisks) || i < len(over.HardDisks); i++ {
+		var d diskSpec
+		if i < len(base.HardDisks) {
+			d = base.HardDisks[i]
+		}
+		if i < len(over.HardDisks) {
+			d = mergeDisk(d, over.HardDisks[i])
+		}
+		s.HardDisks = append(s.HardDisks, d)
+	}
+
+	s.CustomConfigurations = make(map[string]string)
+	for k, v := range base.CustomConfigurations {
+		s.CustomConfigurations[k] = v
+	}
+	for k, v := range over.CustomConfigurations {
+		s.CustomConfigurations[k] = v
+	}
+	return s
+}
+
+func mergeNIC(base, over nicSpec) nicSpec {
+	n := base
+	setString(&n.DeviceName, over.DeviceName)
+	setString(&n.Label, over.Label)
+	setString(&n.IPv4Address, over.IPv4Address)
+	setString(&n.IPv4Pool, over.IPv4Pool)
+	if over.IPv4PrefixLength != 0 {
+		n.IPv4PrefixLength = over.IPv4PrefixLength
+	}
+	setString(&n.IPv6Address, over.IPv6Address)
+	if over.IPv6PrefixLength != 0 {
+		n.IPv6PrefixLength = over.IPv6PrefixLength
+	}
+	setString(&n.IPv6Mode, over.IPv6Mode)
+	setString(&n.AdapterType, over.AdapterType)
+	setString(&n.MacAddress, over.MacAddress)
+	if over.WakeOnLan != nil {
+		n.WakeOnLan = over.WakeOnLan
+	}
+	if over.StartConnected != nil {
+		n.StartConnected = over.StartConnected
+	}
+	setString(&n.Gateway, over.Gateway)
+	setString(&n.IPv6Gateway, over.IPv6Gateway)
+	if over.Routes != nil {
+		n.Routes = over.Routes
+	}
+	return n
+}
+
+func mergeWindows(base, over windowsSpec) windowsSpec {
+	w := base
+	setString(&w.AdminPassword, over.AdminPassword)
+	setString(&w.FullName, over.FullName)
+	setString(&w.OrgName, over.OrgName)
+	setString(&w.ProductKey, over.ProductKey)
+	setString(&w.Workgroup, over.Workgroup)
+	setString(&w.JoinDomain, over.JoinDomain)
+	setString(&w.DomainUser, over.DomainUser)
+	setString(&w.DomainPassword, over.DomainPassword)
+	if over.AutoLogonCount != 0 {
+		w.AutoLogonCount = over.AutoLogonCount
+	}
+	if over.RunOnce != nil {
+		w.RunOnce = over.RunOnce
+	}
+	return w
+}
+
+func mergeDisk(base, over diskSpec) diskSpec {
+	d := base
+	if over.Size != 0 {
+		d.Size = over.Size
+	}
+	if over.IOPS != 0 {
+		d.IOPS = over.IOPS
+	}
+	setString(&d.InitType, over.InitType)
+	setString(&d.Datastore, over.Datastore)
+	setString(&d.Controller, over.Controller)
+	if over.UnitNumber != nil {
+		d.UnitNumber = over.UnitNumber
+	}
+	setString(&d.DiskMode, over.DiskMode)
+	return d
+}
+
+func setString(dst *string, v string) {
+	if v != "" {
+		*dst = v
+	}
+}
+
+// splitCIDRs moves the prefix of addresses written as 10.1.2.3/24 to the
+// prefix length fields.
+func (s *vmSpec) splitCIDRs() error {
+	for i := range s.NetworkInterfaces {
+		n := &s.NetworkInterfaces[i]
+		var err error
+		n.IPv4Address, n.IPv4PrefixLength, err = splitCIDR(n.IPv4Address, n.IPv4PrefixLength)
+		if err != nil {
+			return fmt.Errorf("networkInterfaces[%d].ipv4Address: %s", i, err)
+		}
+		n.IPv6Address, n.IPv6PrefixLength, err = splitCIDR(n.IPv6Address, n.IPv6PrefixLength)
+		if err != nil {
+			return fmt.Errorf("networkInterfaces[%d].ipv6Address: %s", i, err)
+		}
+	}
+	return nil
+}
+
+// validate checks the fields deployVirtualMachine cannot do without.
+func (s *vmSpec) validate() error {
+	required := []struct {
+		key   string
+		value string
+	}{
+		{"name", s.Name},
+		{"template", s.Template},
+		{"datastore", s.Datastore},
+	}
+	for _, r := range required {
+		if r.value == "" {
+			return fmt.Errorf("%s is required", r.key)
+		}
+	}
+	if len(s.NetworkInterfaces) == 0 {
+		return fmt.Errorf("networkInterfaces needs at least one entry")
+	}
+	if err := s.validateCount(); err != nil {
+		return err
+	}
+	switch s.NICPolicy {
+	case "", nicPolicyReplace, nicPolicyKeep, nicPolicyEdit:
+	default:
+		return fmt.Errorf("nicPolicy '%s' is not one of replace, keep, edit", s.NICPolicy)
+	}
+	for i, n := range s.NetworkInterfaces {
+		if _, err := newEthernetCard(n.AdapterType); err != nil {
+			return fmt.Errorf("networkInterfaces[%d]: %s", i, err)
+		}
+		if n.MacAddress != "" {
+			if err := validMAC(n.MacAddress); err != nil {
+				return fmt.Errorf("networkInterfaces[%d]: %s", i, err)
+			}
+		}
+		if n.IPv4Pool != "" && n.IPv4Address != "" {
+			return fmt.Errorf("networkInterfaces[%d]: ipv4Address and ipv4Pool exclude each other", i)
+		}
+		switch n.IPv6Mode {
+		case ipv6None, ipv6Static:
+		case ipv6SLAAC, ipv6DHCP:
+			if n.IPv6Address != "" {
+				return fmt.Errorf("networkInterfaces[%d]: ipv6Address conflicts with ipv6Mode %s", i, n.IPv6Mode)
+			}
+		default:
+			return fmt.Errorf("networkInterfaces[%d]: ipv6Mode '%s' is not one of static, slaac, dhcp", i, n.IPv6Mode)
+		}
+		if n.IPv6Mode == ipv6Static && n.IPv6Address == "" {
+			return fmt.Errorf("networkInterfaces[%d]: ipv6Mode static needs an ipv6Address", i)
+		}
+	}
+	w := s.Windows
+	if w.JoinDomain != "" && w.Workgroup != "" {
+		return fmt.Errorf("windows.joinDomain and windows.workgroup exclude each other")
+	}
+	if w.JoinDomain != "" && (w.DomainUser == "" || w.DomainPassword == "") {
+		return fmt.Errorf("windows.joinDomain needs windows.domainUser and windows.domainPassword")
+	}
+	if w.AutoLogonCount > 0 && w.AdminPassword == "" {
+		return fmt.Errorf("windows.autoLogonCount needs windows.adminPassword")
+	}
+	if len(w.RunOnce) > 0 && (w.AutoLogonCount == 0 || w.AdminPassword == "") {
+		// GuiRunOnce only runs at an interactive logon
+		return fmt.Errorf("windows.runOnce needs windows.autoLogonCount and windows.adminPassword to ever run")
+	}
+	switch s.Shell {
+	case "", shellSh, shellCmd, shellPowerShell:
+	default:
+		return fmt.Errorf("shell '%s' is not one of sh, cmd, powershell", s.Shell)
+	}
+	instant := s.Instant != nil && *s.Instant
+	if instant && s.Linked != nil && !*s.Linked {
+		return fmt.Errorf("instant clones fall back to linked clones, drop linked: false")
+	}
+	if s.Snapshot != "" && (s.Linked == nil || !*s.Linked) && !instant {
+		linkedDisks := false
+		for _, d := range s.HardDisks {
+			linkedDisks = linkedDisks || d.InitType == initLinked
+		}
+		if !linkedDisks {
+			return fmt.Errorf("snapshot is only used by linked clones, set linked")
+		}
+	}
+	linkedClone := instant || (s.Linked != nil && *s.Linked)
+	for i, d := range s.HardDisks {
+		switch d.InitType {
+		case "", initThin, initThick, initEagerZeroed, initLinked:
+		default:
+			return fmt.Errorf("hardDisks[%d].initType '%s' is not one of thin, thick, eager_zeroed, linked", i, d.InitType)
+		}
+		if d.InitType == initLinked && d.DiskMode != "" {
+			return fmt.Errorf("hardDisks[%d]: a linked disk keeps the diskMode of the template", i)
+		}
+		// hardDisks[0] is always a template disk; later ones may be new
+		// disks, which configureDisks checks once the template is known
+		if d.Size != 0 && (d.InitType == initLinked || (linkedClone && i == 0)) {
+			return fmt.Errorf("hardDisks[%d]: a linked template disk cannot grow, drop size", i)
+		}
+		if err := validateDiskPlacement(d.Controller, d.UnitNumber, d.DiskMode); err != nil {
+			return fmt.Errorf("hardDisks[%d]: %s", i, err)
+		}
+	}
+	return nil
+}
+
+// virtualMachine converts a merged spec to the deploy object.
+func (s *vmSpec) virtualMachine() virtualMachine {
+	vm := virtualMachine{
+		name:          s.Name,
+		folder:        s.Folder,
+		datacenter:    s.Datacenter,
+		cluster:       s.Cluster,
+		resourcePool:  s.ResourcePool,
+		datastore:     s.Datastore,
+		vcpu:          s.VCPU,
+		memoryMb:      s.MemoryMb,
+		template:      s.Template,
+		nicPolicy:     s.NICPolicy,
+		guestHostName: s.HostName,
+		gateway:       s.Gateway,
+		ipv6Gateway:   s.IPv6Gateway,
+		domain:        s.Domain,
+		timeZone:      s.TimeZone,
+		dnsSuffixes:   s.DNSSuffixes,
+		dnsServers:    s.DNSServers,
+		host:          s.Host,
+	}
+	if len(vm.dnsSuffixes) == 0 {
+		vm.dnsSuffixes = DefaultDNSSuffixes
+	}
+	if len(vm.dnsServers) == 0 {
+		vm.dnsServers = DefaultDNSServers
+	}
+
+	for _, n := range s.NetworkInterfaces {
+		var routes []staticRoute
+		for _, r := range n.Routes {
+			routes = append(routes, staticRoute{to: r.To, via: r.Via})
+		}
+		vm.networkInterfaces = append(vm.networkInterfaces, networkInterface{
+			deviceName:       n.DeviceName,
+			label:            n.Label,
+			ipv4Address:      n.IPv4Address,
+			ipv4PrefixLength: n.IPv4PrefixLength,
+			ipv6Address:      n.IPv6Address,
+			ipv6PrefixLength: n.IPv6PrefixLength,
+			ipv6AddrMode:     n.IPv6Mode,
+			adapterType:      n.AdapterType,
+			macAddress:       n.MacAddress,
+			wakeOnLan:        n.WakeOnLan,
+			startConnected:   n.StartConnected,
+			gateway:          n.Gateway,
+			ipv6Gateway:      n.IPv6Gateway,
+			routes:           routes,
+		})
+	}
+
+	for _, d := range s.HardDisks {
+		vm.hardDisks = append(vm.hardDisks, hardDisk{
+			size:       d.Size,
+			iops:       d.IOPS,
+			initType:   d.InitType,
+			datastore:  d.Datastore,
+			controller: d.Controller,
+			unitNumber: d.UnitNumber,
+			diskMode:   d.DiskMode,
+		})
+	}
+	vm.linked = s.Linked != nil && *s.Linked
+	vm.instant = s.Instant != nil && *s.Instant
+	vm.snapshot = s.Snapshot
+	// hardDisks[0] always describes the template disk
+	if len(vm.hardDisks) == 0 {
+		vm.hardDisks = append(vm.hardDisks, hardDisk{})
+	}
+
+	if len(s.CustomConfigurations) > 0 {
+		vm.customConfigurations = make(map[string]types.AnyType)
+		for k, v := range s.CustomConfigurations {
+			vm.customConfigurations[k] = v
+		}
+	}
+	if s.CustomizationSpec != "" {
+		vm.customizationSpecification = map[string]types.AnyType{"name": s.CustomizationSpec}
+	}
+
+	w := s.Windows
+	vm.windows = windowsOptions{
+		adminPassword:  w.AdminPassword,
+		fullName:       w.FullName,
+		orgName:        w.OrgName,
+		productKey:     w.ProductKey,
+		workgroup:      w.Workgroup,
+		joinDomain:     w.JoinDomain,
+		domainUser:     w.DomainUser,
+		domainPassword: w.DomainPassword,
+		autoLogonCount: w.AutoLogonCount,
+		runOnce:        w.RunOnce,
+	}
+	vm.postCommands = s.PostCommands
+	vm.shell = s.Shell
+	return vm
+}
@@ -0,0 +1,350 @@
+package virtualmachine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// validSpec returns the smallest vm entry validate accepts.
+func validSpec() vmSpec {
+	return vmSpec{
+		Name:              "vm",
+		Template:          "tlp",
+		Datastore:         "ds",
+		NetworkInterfaces: []nicSpec{{Label: "VM Network"}},
+	}
+}
+
+// checkErr fails t unless err matches want, a part of the message or ""
+// for no error.
+func checkErr(t *testing.T, err error, want string) {
+	t.Helper()
+	switch {
+	case want == "" && err != nil:
+		t.Errorf("unexpected error: %s", err)
+	case want != "" && err == nil:
+		t.Errorf("no error, want one with %q", want)
+	case want != "" && !strings.Contains(err.Error(), want):
+		t.Errorf("error %q, want one with %q", err, want)
+	}
+}
+
+// writeManifest writes content to a file called name in a new temporary
+// directory and returns its path and a func removing the directory.
+func writeManifest(t *testing.T, name, content string) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestMergeSpec(t *testing.T) {
+	yes := true
+	base := vmSpec{
+		Template:             "tlp",
+		Datastore:            "ds1",
+		VCPU:                 2,
+		MemoryMb:             4096,
+		DNSServers:           []string{"8.8.8.8"},
+		NetworkInterfaces:    []nicSpec{{Label: "VM Network", IPv4PrefixLength: 24}},
+		HardDisks:            []diskSpec{{InitType: initThick}},
+		CustomConfigurations: map[string]string{"a": "1", "b": "2"},
+		PostCommands:         []string{"uptime"},
+	}
+	over := vmSpec{
+		Name:                 "web",
+		Datastore:            "ds2",
+		VCPU:                 4,
+		Linked:               &yes,
+		NetworkInterfaces:    []nicSpec{{IPv4Address: "10.0.0.5"}, {Label: "Backup"}},
+		HardDisks:            []diskSpec{{}, {Size: 100}},
+		CustomConfigurations: map[string]string{"b": "3"},
+		PostCommands:         []string{},
+	}
+	want := vmSpec{
+		Name:                 "web",
+		Template:             "tlp",
+		Datastore:            "ds2",
+		VCPU:                 4,
+		MemoryMb:             4096,
+		DNSServers:           []string{"8.8.8.8"},
+		Linked:               &yes,
+		NetworkInterfaces:    []nicSpec{{Label: "VM Network", IPv4Address: "10.0.0.5", IPv4PrefixLength: 24}, {Label: "Backup"}},
+		HardDisks:            []diskSpec{{InitType: initThick}, {Size: 100}},
+		CustomConfigurations: map[string]string{"a": "1", "b": "3"},
+		PostCommands:         []string{},
+	}
+	if got := mergeSpec(base, over); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+	if base.CustomConfigurations["b"] != "2" {
+		t.Error("mergeSpec changed the custom configurations of base")
+	}
+}
+
+func TestSplitCIDRs(t *testing.T) {
+	tests := []struct {
+		name   string
+		nic    nicSpec
+		want   nicSpec
+		errStr string
+	}{
+		{"plain", nicSpec{IPv4Address: "10.0.0.5", IPv4PrefixLength: 24}, nicSpec{IPv4Address: "10.0.0.5", IPv4PrefixLength: 24}, ""},
+		{"cidr", nicSpec{IPv4Address: "10.0.0.5/16"}, nicSpec{IPv4Address: "10.0.0.5", IPv4PrefixLength: 16}, ""},
+		{"ipv6 cidr", nicSpec{IPv6Address: "fd00::5/64"}, nicSpec{IPv6Address: "fd00::5", IPv6PrefixLength: 64}, ""},
+		{"bad cidr", nicSpec{IPv4Address: "10.0.0.5/40"}, nicSpec{}, "networkInterfaces[0].ipv4Address"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := vmSpec{NetworkInterfaces: []nicSpec{tt.nic}}
+			err := s.splitCIDRs()
+			checkErr(t, err, tt.errStr)
+			if err == nil && !reflect.DeepEqual(s.NetworkInterfaces[0], tt.want) {
+				t.Errorf("got %+v, want %+v", s.NetworkInterfaces[0], tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(s *vmSpec)
+		want string
+	}{
+		{"valid", func(s *vmSpec) {}, ""},
+		{"no name", func(s *vmSpec) { s.Name = "" }, "name is required"},
+		{"no template", func(s *vmSpec) { s.Template = "" }, "template is required"},
+		{"no datastore", func(s *vmSpec) { s.Datastore = "" }, "datastore is required"},
+		{"no nics", func(s *vmSpec) { s.NetworkInterfaces = nil }, "at least one entry"},
+		{"nic policy", func(s *vmSpec) { s.NICPolicy = "merge" }, "nicPolicy 'merge'"},
+		{"adapter type", func(s *vmSpec) { s.NetworkInterfaces[0].AdapterType = "pcnet" }, "networkInterfaces[0]"},
+		{"shell", func(s *vmSpec) { s.Shell = "bash" }, "shell 'bash'"},
+		{"snapshot without linked", func(s *vmSpec) { s.Snapshot = "base" }, "set linked"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := validSpec()
+			tt.edit(&s)
+			checkErr(t, s.validate(), tt.want)
+		})
+	}
+}
+
+func TestLoadManifest(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		names   []string
+		want    string
+	}{
+		{
+			name:    "defaults merged",
+			file:    "vms.yaml",
+			content: "defaults:\n  template: tlp\n  datastore: ds1\n  networkInterfaces:\n    - label: VM Network\nvms:\n  - name: a\n  - name: b\n    datastore: ds2\n",
+			names:   []string{"a", "b"},
+		},
+		{
+			name:    "json",
+			file:    "vms.json",
+			content: `{"vms": [{"name": "a", "template": "tlp", "datastore": "ds1", "networkInterfaces": [{"label": "VM Network"}]}]}`,
+			names:   []string{"a"},
+		},
+		{
+			name:    "unknown key",
+			file:    "vms.yaml",
+			content: "vms:\n  - name: a\n    datastores: ds1\n",
+			want:    "Error parse manifest",
+		},
+		{
+			name:    "unknown json key",
+			file:    "vms.json",
+			content: `{"vms": [{"nam": "a"}]}`,
+			want:    "unknown field",
+		},
+		{
+			name:    "no vms",
+			file:    "vms.yaml",
+			content: "defaults:\n  template: tlp\n",
+			want:    "no vms declared",
+		},
+		{
+			name:    "invalid entry",
+			file:    "vms.yaml",
+			content: "vms:\n  - name: a\n    template: tlp\n",
+			want:    "vms[0] (a): datastore is required",
+		},
+		{
+			name:    "duplicate",
+			file:    "vms.yaml",
+			content: "defaults:\n  template: tlp\n  datastore: ds1\n  networkInterfaces:\n    - label: VM Network\nvms:\n  - name: a\n  - name: a\n",
+			want:    "also declared by vms[0]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, cleanup := writeManifest(t, tt.file, tt.content)
+			defer cleanup()
+			vms, err := loadManifest(path)
+			checkErr(t, err, tt.want)
+			var names []string
+			for _, vm := range vms {
+				names = append(names, vm.name)
+			}
+			if !reflect.DeepEqual(names, tt.names) {
+				t.Errorf("vms %v, want %v", names, tt.names)
+			}
+		})
+	}
+}
+
+// TestSampleVMLists keeps the sample files of the repository loadable.
+func TestSampleVMLists(t *testing.T) {
+	for _, path := range []string{"../vmlist.yaml", "../vmlist"} {
+		t.Run(path, func(t *testing.T) {
+			vms, err := createVMObjs(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(vms) == 0 {
+				t.Error("no vms")
+			}
+		})
+	}
+}
+
+func TestLegacyVMList(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    networkInterface
+		gateway string
+		err     string
+	}{
+		{
+			name:    "default prefix",
+			content: "# address name host datastore template gateway\n10.10.10.21 web h1 ds1 tlp 10.10.10.1\n",
+			want:    networkInterface{ipv4Address: "10.10.10.21", ipv4PrefixLength: 24},
+			gateway: "10.10.10.1",
+		},
+		{
+			name:    "prefix",
+			content: "10.10.10.21/16  web h1 ds1 tlp 10.10.0.1\n",
+			want:    networkInterface{ipv4Address: "10.10.10.21", ipv4PrefixLength: 16},
+			gateway: "10.10.0.1",
+		},
+		{name: "no gateway", content: "10.10.10.21 web h1 ds1 tlp\n", err: "line 1: no gateway"},
+		{name: "gateway outside", content: "\n10.10.10.21 web h1 ds1 tlp 10.10.11.1\n", err: "line 2: gateway 10.10.11.1 is outside"},
+		{name: "bad address", content: "10.10.10.21/40 web h1 ds1 tlp 10.10.10.1\n", err: "is not an address/prefix"},
+		{name: "columns", content: "10.10.10.21 web\n", err: "want 6 columns, got 2"},
+		{name: "only comments", content: "# nothing\n", err: "declares no vms"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, cleanup := writeManifest(t, "vmlist", tt.content)
+			defer cleanup()
+			vms, err := createVMObjs(path)
+			checkErr(t, err, tt.err)
+			if err != nil {
+				return
+			}
+			vm := vms[0]
+			if vm.name != "web" || vm.host != "h1" || vm.datastore != "ds1" || vm.template != "tlp" || vm.gateway != tt.gateway {
+				t.Errorf("got %+v", vm)
+			}
+			if !reflect.DeepEqual(vm.networkInterfaces, []networkInterface{tt.want}) {
+				t.Errorf("nics %+v, want %+v", vm.networkInterfaces, tt.want)
+			}
+			if gw := vm.nicGateway(vm.networkInterfaces[0]); gw != tt.gateway {
+				t.Errorf("nic gateway %q, want %q", gw, tt.gateway)
+			}
+		})
+	}
+}
+
+func TestValidateWindows(t *testing.T) {
+	tests := []struct {
+		name    string
+		windows windowsSpec
+		want    string
+	}{
+		{"none", windowsSpec{}, ""},
+		{"auto logon", windowsSpec{AdminPassword: "pw", AutoLogonCount: 1}, ""},
+		{"auto logon without password", windowsSpec{AutoLogonCount: 1}, "needs windows.adminPassword"},
+		{"run once with auto logon", windowsSpec{AdminPassword: "pw", AutoLogonCount: 1, RunOnce: []string{"cmd"}}, ""},
+		{"run once without auto logon", windowsSpec{AdminPassword: "pw", RunOnce: []string{"cmd"}}, "windows.runOnce needs"},
+		{"run once without anything", windowsSpec{RunOnce: []string{"cmd"}}, "windows.runOnce needs"},
+		{"domain and workgroup", windowsSpec{JoinDomain: "ad", Workgroup: "wg"}, "exclude each other"},
+		{"domain without user", windowsSpec{JoinDomain: "ad"}, "needs windows.domainUser"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := validSpec()
+			s.Windows = tt.windows
+			checkErr(t, s.validate(), tt.want)
+		})
+	}
+}
+
+func TestValidateLinkedDisks(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		name    string
+		linked  *bool
+		instant *bool
+		disks   []diskSpec
+		want    string
+	}{
+		{"full clone grows", nil, nil, []diskSpec{{Size: 40}}, ""},
+		{"linked clone", &yes, nil, []diskSpec{{}}, ""},
+		{"linked clone grows", &yes, nil, []diskSpec{{Size: 40}}, "cannot grow"},
+		{"linked clone adds a disk", &yes, nil, []diskSpec{{}, {Size: 100}}, ""},
+		{"instant clone grows", nil, &yes, []diskSpec{{Size: 40}}, "cannot grow"},
+		{"linked disk grows", nil, nil, []diskSpec{{}, {InitType: initLinked, Size: 100}}, "hardDisks[1]: a linked"},
+		{"linked disk with mode", nil, nil, []diskSpec{{InitType: initLinked, DiskMode: "persistent"}}, "keeps the diskMode"},
+		{"instant and not linked", &no, &yes, nil, "drop linked: false"},
+		{"unknown init type", nil, nil, []diskSpec{{InitType: "sparse"}}, "initType 'sparse'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := validSpec()
+			s.Linked, s.Instant, s.HardDisks = tt.linked, tt.instant, tt.disks
+			checkErr(t, s.validate(), tt.want)
+		})
+	}
+}
+
+func TestValidateIPv6(t *testing.T) {
+	tests := []struct {
+		name string
+		nic  nicSpec
+		want string
+	}{
+		{"static", nicSpec{IPv6Address: "fd00::5", IPv6PrefixLength: 64}, ""},
+		{"explicit static", nicSpec{IPv6Mode: ipv6Static, IPv6Address: "fd00::5", IPv6PrefixLength: 64}, ""},
+		{"static without address", nicSpec{IPv6Mode: ipv6Static}, "needs an ipv6Address"},
+		{"slaac", nicSpec{IPv6Mode: ipv6SLAAC}, ""},
+		{"dhcp with address", nicSpec{IPv6Mode: ipv6DHCP, IPv6Address: "fd00::5"}, "conflicts with ipv6Mode dhcp"},
+		{"unknown mode", nicSpec{IPv6Mode: "auto"}, "ipv6Mode 'auto'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := validSpec()
+			tt.nic.Label = "VM Network"
+			s.NetworkInterfaces = []nicSpec{tt.nic}
+			checkErr(t, s.validate(), tt.want)
+		})
+	}
+}
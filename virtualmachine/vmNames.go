@@ -0,0 +1,117 @@
+package virtualmachine
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// nameVar matches a pattern variable: {{.Index}}, or {{.Index:02}} for a
+// number padded with zeros to two digits.
+var nameVar = regexp.MustCompile(`\{\{\s*\.(\w+)(?::(\d+))?\s*\}\}`)
+
+// nameVars lists the variables of name and hostName patterns.
+const nameVars = ".Index, .Count, .Template, .IP, .Host, .Datastore, .Cluster, .Folder, .Datacenter, .Name (hostName only)"
+
+// expandName replaces the variables of pattern with the values of copy
+// index (from 1) of s. name is the expanded vm name, empty while the name
+// itself is expanded.
+func (s *vmSpec) expandName(pattern string, index int, name string) (string, error) {
+	var err error
+	expanded := nameVar.ReplaceAllStringFunc(pattern, func(v string) string {
+		m := nameVar.FindStringSubmatch(v)
+		value, numeric, verr := s.nameValue(m[1], index, name)
+		switch {
+		case verr != nil:
+		case m[2] != "" && !numeric:
+			verr = fmt.Errorf("only .Index and .Count take a width, not .%s", m[1])
+		case m[2] != "":
+			width, _ := strconv.Atoi(m[2])
+			n, _ := strconv.Atoi(value)
+			value = fmt.Sprintf("%0*d", width, n)
+		}
+		if verr != nil && err == nil {
+			err = verr
+		}
+		return value
+	})
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(expanded, "{{") {
+		return "", fmt.Errorf("'%s' has a malformed variable, use {{.Var}} with one of %s", pattern, nameVars)
+	}
+	return expanded, nil
+}
+
+// nameValue returns the value of the pattern variable key and whether it
+// is a number.
+func (s *vmSpec) nameValue(key string, index int, name string) (string, bool, error) {
+	switch key {
+	case "Index":
+		return strconv.Itoa(index), true, nil
+	case "Count":
+		count := s.Count
+		if count == 0 {
+			count = 1
+		}
+		return strconv.Itoa(count), true, nil
+	case "Template":
+		return s.Template, false, nil
+	case "Host":
+		if s.Host == "" {
+			return "", false, fmt.Errorf(".Host needs a host, without one it is picked at clone time")
+		}
+		return s.Host, false, nil
+	case "Datastore":
+		return s.Datastore, false, nil
+	case "Cluster":
+		return s.Cluster, false, nil
+	case "Folder":
+		return s.Folder, false, nil
+	case "Datacenter":
+		return s.Datacenter, false, nil
+	case "IP":
+		n := s.NetworkInterfaces[0]
+		switch {
+		case n.IPv4Pool != "":
+			return "", false, fmt.Errorf(".IP is not known before the pool lease of networkInterfaces[0], use .Index")
+		case n.IPv4Address != "":
+			return n.IPv4Address, false, nil
+		case n.IPv6Address != "":
+			return n.IPv6Address, false, nil
+		}
+		return "", false, fmt.Errorf(".IP needs a static address on networkInterfaces[0]")
+	case "Name":
+		if name != "" {
+			return name, false, nil
+		}
+	}
+	return "", false, fmt.Errorf("unknown variable .%s, one of %s", key, nameVars)
+}
+
+// validateCount checks that the count copies of s can tell apart.
+func (s *vmSpec) validateCount() error {
+	if s.Count < 0 {
+		return fmt.Errorf("count %d is negative", s.Count)
+	}
+	if s.Count <= 1 {
+		return nil
+	}
+	indexed := false
+	for _, m := range nameVar.FindAllStringSubmatch(s.Name, -1) {
+		if m[1] == "Index" {
+			indexed = true
+		}
+	}
+	if !indexed {
+		return fmt.Errorf("count %d needs {{.Index}} in the name", s.Count)
+	}
+	for i, n := range s.NetworkInterfaces {
+		if n.IPv4Address != "" || n.IPv6Address != "" {
+			return fmt.Errorf("networkInterfaces[%d]: count %d would repeat its static address, use ipv4Pool or dhcp", i, s.Count)
+		}
+	}
+	return nil
+}
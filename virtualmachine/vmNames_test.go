@@ -0,0 +1,120 @@
+package virtualmachine
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpandName(t *testing.T) {
+	spec := vmSpec{
+		Template:          "centos6.7",
+		Count:             12,
+		Host:              "esx01",
+		Datastore:         "ds1",
+		Cluster:           "lab",
+		Folder:            "web",
+		Datacenter:        "dc1",
+		NetworkInterfaces: []nicSpec{{IPv4Address: "10.10.10.10"}},
+	}
+	tests := []struct {
+		name    string
+		pattern string
+		vmName  string
+		want    string
+		err     string
+	}{
+		{"literal", "centos6.7(10.10.10.10)", "", "centos6.7(10.10.10.10)", ""},
+		{"index", "web-{{.Index}}", "", "web-3", ""},
+		{"padded index", "web-{{.Index:03}}", "", "web-003", ""},
+		{"spaces", "web-{{ .Index:02 }}-of-{{.Count}}", "", "web-03-of-12", ""},
+		{"placement", "{{.Datacenter}}-{{.Cluster}}-{{.Host}}-{{.Datastore}}-{{.Folder}}", "", "dc1-lab-esx01-ds1-web", ""},
+		{"template and ip", "{{.Template}}({{.IP}})_huiyuan", "", "centos6.7(10.10.10.10)_huiyuan", ""},
+		{"hostName from the name", "{{.Name}}", "web-003", "web-003", ""},
+		{"name in a name", "{{.Name}}", "", "", "unknown variable .Name"},
+		{"unknown", "{{.Cpu}}", "", "", "unknown variable .Cpu"},
+		{"width on text", "{{.Template:04}}", "", "", "only .Index and .Count take a width"},
+		{"malformed", "web-{{Index}}", "", "", "has a malformed variable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := spec.expandName(tt.pattern, 3, tt.vmName)
+			checkErr(t, err, tt.err)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandNameIP(t *testing.T) {
+	tests := []struct {
+		name string
+		nic  nicSpec
+		want string
+		err  string
+	}{
+		{"ipv4", nicSpec{IPv4Address: "10.10.10.10"}, "10.10.10.10", ""},
+		{"ipv6", nicSpec{IPv6Address: "fd00::10"}, "fd00::10", ""},
+		{"pool", nicSpec{IPv4Pool: "lab"}, "", "not known before the pool lease"},
+		{"dhcp", nicSpec{}, "", "needs a static address"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := vmSpec{NetworkInterfaces: []nicSpec{tt.nic}}
+			got, err := s.expandName("{{.IP}}", 1, "")
+			checkErr(t, err, tt.err)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if _, err := (&vmSpec{}).expandName("{{.Host}}", 1, ""); err == nil {
+		t.Error(".Host expanded without a host")
+	}
+}
+
+func TestValidateCount(t *testing.T) {
+	tests := []struct {
+		name  string
+		count int
+		vm    string
+		nic   nicSpec
+		err   string
+	}{
+		{"single", 0, "vm", nicSpec{IPv4Address: "10.10.10.10"}, ""},
+		{"one", 1, "vm", nicSpec{IPv4Address: "10.10.10.10"}, ""},
+		{"indexed", 3, "web-{{.Index:02}}", nicSpec{IPv4Pool: "lab"}, ""},
+		{"negative", -1, "vm", nicSpec{}, "count -1 is negative"},
+		{"no index", 3, "web-{{.Count}}", nicSpec{}, "needs {{.Index}} in the name"},
+		{"static ipv4", 3, "web-{{.Index}}", nicSpec{IPv4Address: "10.10.10.10"}, "would repeat its static address"},
+		{"static ipv6", 3, "web-{{.Index}}", nicSpec{IPv6Address: "fd00::10"}, "would repeat its static address"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := vmSpec{Name: tt.vm, Count: tt.count, NetworkInterfaces: []nicSpec{tt.nic}}
+			checkErr(t, s.validateCount(), tt.err)
+		})
+	}
+}
+
+func TestEntryVMsCount(t *testing.T) {
+	s := validSpec()
+	s.Name = "web-{{.Index:02}}.lab.local"
+	s.HostName = "{{.Name}}"
+	s.Count = 3
+	vms, err := entryVMs(s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names, hosts []string
+	for i := range vms {
+		names = append(names, vms[i].name)
+		hosts = append(hosts, vms[i].hostName())
+	}
+	if want := []string{"web-01.lab.local", "web-02.lab.local", "web-03.lab.local"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("names %v, want %v", names, want)
+	}
+	if want := []string{"web-01", "web-02", "web-03"}; !reflect.DeepEqual(hosts, want) {
+		t.Errorf("host names %v, want %v", hosts, want)
+	}
+}
@@ -0,0 +1,333 @@
+package virtualmachine
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"golang.org/x/net/context"
+)
+
+const defaultAdapterType = "vmxnet3"
+
+// nic policies: what a clone does with the nics of its template
+const (
+	// nicPolicyReplace removes every template nic and adds the spec nics
+	nicPolicyReplace = "replace"
+	// nicPolicyKeep leaves the template nics as they are
+	nicPolicyKeep = "keep"
+	// nicPolicyEdit moves the template nics to the spec networks in
+	// place, keeping their macs and pci slots
+	nicPolicyEdit = "edit"
+)
+
+// adapterTypes maps the adapterType of a nic to its virtual device.
+var adapterTypes = map[string]func() types.BaseVirtualEthernetCard{
+	"e1000":   func() types.BaseVirtualEthernetCard { return &types.VirtualE1000{} },
+	"e1000e":  func() types.BaseVirtualEthernetCard { return &types.VirtualE1000e{} },
+	"vmxnet2": func() types.BaseVirtualEthernetCard { return &types.VirtualVmxnet2{} },
+	"vmxnet3": func() types.BaseVirtualEthernetCard { return &types.VirtualVmxnet3{} },
+	"pcnet32": func() types.BaseVirtualEthernetCard { return &types.VirtualPCNet32{} },
+	"sriov":   func() types.BaseVirtualEthernetCard { return &types.VirtualSriovEthernetCard{} },
+}
+
+// newEthernetCard returns an empty nic of adapterType, vmxnet3 when empty.
+func newEthernetCard(adapterType string) (types.BaseVirtualEthernetCard, error) {
+	if adapterType == "" {
+		adapterType = defaultAdapterType
+	}
+	fn, ok := adapterTypes[adapterType]
+	if !ok {
+		return nil, fmt.Errorf("Invalid network adapter type '%s', must be one of %s", adapterType, adapterTypeNames())
+	}
+	return fn(), nil
+}
+
+// adapterTypeOf returns the adapterType of an existing nic.
+func adapterTypeOf(nic types.BaseVirtualDevice) string {
+	switch nic.(type) {
+	case *types.VirtualE1000:
+		return "e1000"
+	case *types.VirtualE1000e:
+		return "e1000e"
+	case *types.VirtualVmxnet2:
+		return "vmxnet2"
+	case *types.VirtualVmxnet3:
+		return "vmxnet3"
+	case *types.VirtualPCNet32:
+		return "pcnet32"
+	case *types.VirtualSriovEthernetCard:
+		return "sriov"
+	}
+	return ""
+}
+
+func adapterTypeNames() string {
+	var names []string
+	for name := range adapterTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// validMAC checks that mac is a static address vCenter accepts, which must
+// lie in 00:50:56:00:00:00 - 00:50:56:3f:ff:ff.
+func validMAC(mac string) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return err
+	}
+	if len(hw) != 6 || hw[0] != 0x00 || hw[1] != 0x50 || hw[2] != 0x56 || hw[3] > 0x3f {
+		return fmt.Errorf("macAddress %s is outside the static range 00:50:56:00:00:00 - 00:50:56:3f:ff:ff", mac)
+	}
+	return nil
+}
+
+// ipv6 setups of a nic
+const (
+	ipv6None   = ""
+	ipv6Static = "static"
+	ipv6SLAAC  = "slaac"
+	ipv6DHCP   = "dhcp"
+)
+
+// ipv6Mode returns how nic gets its ipv6 address: static when it has
+// one, else whatever ipv6Mode the spec set.
+func (nic networkInterface) ipv6Mode() string {
+	if nic.ipv6Address != "" {
+		return ipv6Static
+	}
+	return nic.ipv6AddrMode
+}
+
+// static reports whether nic has a fixed ipv4 or ipv6 address.
+func (nic networkInterface) static() bool {
+	return nic.ipv4Address != "" || nic.ipv6Address != ""
+}
+
+// staticIPs returns every fixed address of vm, the ones the guest must
+// report before it counts as up.
+func (vm *virtualMachine) staticIPs() []string {
+	var ips []string
+	for _, n := range vm.networkInterfaces {
+		if n.ipv4Address != "" {
+			ips = append(ips, n.ipv4Address)
+		}
+		if n.ipv6Address != "" {
+			ips = append(ips, n.ipv6Address)
+		}
+	}
+	return ips
+}
+
+// configureEthernetCard connects card to the network of nic and applies
+// its mac and connection settings.
+func configureEthernetCard(ctx context.Context, dc *object.Datacenter, nic networkInterface, card types.BaseVirtualEthernetCard) error {
+	network, err := findNetwork(ctx, dc, nic.label)
+	if err != nil {
+		return err
+	}
+	backing, err := networkBacking(ctx, dc, network)
+	if err != nil {
+		return err
+	}
+
+	c := card.GetVirtualEthernetCard()
+	c.Backing = backing
+	if c.AddressType == "" {
+		c.AddressType = string(types.VirtualEthernetCardMacTypeGenerated)
+	}
+	if nic.macAddress != "" {
+		c.AddressType = string(types.VirtualEthernetCardMacTypeManual)
+		c.MacAddress = nic.macAddress
+	}
+	if nic.wakeOnLan != nil {
+		c.WakeOnLanEnabled = nic.wakeOnLan
+	}
+	if c.Connectable == nil {
+		c.Connectable = &types.VirtualDeviceConnectInfo{AllowGuestControl: true}
+	}
+	c.Connectable.StartConnected = nic.startConnected == nil || *nic.startConnected
+	return nil
+}
+
+// nicDeviceChanges returns the clone device changes that give a clone of
+// a template with templateDevices the nics, following policy, and the
+// nics the clone ends up with.
+func nicDeviceChanges(ctx context.Context, dc *object.Datacenter, policy string, templateDevices object.VirtualDeviceList, nics []networkInterface) ([]types.BaseVirtualDeviceConfigSpec, []types.BaseVirtualDevice, error) {
+	old := templateDevices.SelectByType((*types.VirtualEthernetCard)(nil))
+	var changes []types.BaseVirtualDeviceConfigSpec
+	var result []types.BaseVirtualDevice
+
+	switch policy {
+	case nicPolicyKeep:
+		return nil, old, nil
+	case "", nicPolicyReplace:
+		for _, dev := range old {
+			changes = append(changes, &types.VirtualDeviceConfigSpec{
+				Operation: types.VirtualDeviceConfigSpecOperationRemove,
+				Device:    dev,
+			})
+		}
+		old = nil
+	case nicPolicyEdit:
+	default:
+		return nil, nil, fmt.Errorf("Invalid nic policy '%s'", policy)
+	}
+
+	// edit: reuse the template nics by position, add or remove the rest.
+	// Every added nic of the one config spec needs its own negative key.
+	key := -1
+	for i, nic := range nics {
+		if i < len(old) {
+			dev := old[i]
+			if nic.adapterType != "" && nic.adapterType != adapterTypeOf(dev) {
+				return nil, nil, fmt.Errorf("nic %d of the template is %s, edit cannot change it to %s",
+					i, adapterTypeOf(dev), nic.adapterType)
+			}
+			if err := configureEthernetCard(ctx, dc, nic, dev.(types.BaseVirtualEthernetCard)); err != nil {
+				return nil, nil, err
+			}
+			changes = append(changes, &types.VirtualDeviceConfigSpec{
+				Operation: types.VirtualDeviceConfigSpecOperationEdit,
+				Device:    dev,
+			})
+			result = append(result, dev)
+			continue
+		}
+		nd, err := buildNetworkDevice(ctx, dc, nic, key)
+		if err != nil {
+			return nil, nil, err
+		}
+		key--
+		changes = append(changes, nd)
+		result = append(result, nd.Device)
+	}
+	for i := len(nics); i < len(old); i++ {
+		changes = append(changes, &types.VirtualDeviceConfigSpec{
+			Operation: types.VirtualDeviceConfigSpecOperationRemove,
+			Device:    old[i],
+		})
+	}
+	return changes, result, nil
+}
+
+// dcNetworks returns every network of dc: standard port groups,
+// distributed port groups and opaque networks.
+func dcNetworks(ctx context.Context, dc *object.Datacenter) ([]mo.Network, error) {
+	var mdc mo.Datacenter
+	if err := dc.Properties(ctx, dc.Reference(), []string{"network"}, &mdc); err != nil {
+		return nil, err
+	}
+	if len(mdc.Network) == 0 {
+		return nil, nil
+	}
+
+	var networks []mo.Network
+	collector := property.DefaultCollector(dc.Client())
+	if err := collector.Retrieve(ctx, mdc.Network, []string{"name", "summary"}, &networks); err != nil {
+		return nil, err
+	}
+	return networks, nil
+}
+
+// findNetwork returns the network of dc named label. An empty label picks
+// the only network of dc.
+func findNetwork(ctx context.Context, dc *object.Datacenter, label string) (*mo.Network, error) {
+	networks, err := dcNetworks(ctx, dc)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []mo.Network
+	for _, n := range networks {
+		if label == "" || n.Name == label {
+			found = append(found, n)
+		}
+	}
+
+	switch {
+	case len(found) == 1:
+		return &found[0], nil
+	case len(found) == 0 && label == "":
+		return nil, &Error{Kind: ErrNotFound, Op: "find network", Err: fmt.Errorf("datacenter has no network")}
+	case len(found) == 0:
+		return nil, &Error{Kind: ErrNotFound, Op: "find network",
+			Err: fmt.Errorf("no network named '%s', have: %s", label, networkNames(networks))}
+	case label == "":
+		return nil, &Error{Kind: ErrInvalidSpec, Op: "find network",
+			Err: fmt.Errorf("no network label set and the datacenter has %d networks: %s", len(found), networkNames(found))}
+	}
+	var refs []string
+	for _, n := range found {
+		refs = append(refs, n.Self.Type+":"+n.Self.Value)
+	}
+	return nil, &Error{Kind: ErrInvalidSpec, Op: "find network",
+		Err: fmt.Errorf("network name '%s' is ambiguous: %s", label, strings.Join(refs, ", "))}
+}
+
+// networkBacking returns the nic backing that connects to network n.
+func networkBacking(ctx context.Context, dc *object.Datacenter, n *mo.Network) (types.BaseVirtualDeviceBackingInfo, error) {
+	switch n.Self.Type {
+	case "DistributedVirtualPortgroup":
+		return object.NewDistributedVirtualPortgroup(dc.Client(), n.Self).EthernetCardBackingInfo(ctx)
+	case "OpaqueNetwork":
+		summary, ok := n.Summary.(*types.OpaqueNetworkSummary)
+		if !ok {
+			return nil, fmt.Errorf("opaque network %s has no opaque summary", n.Name)
+		}
+		return &types.VirtualEthernetCardOpaqueNetworkBackingInfo{
+			OpaqueNetworkId:   summary.OpaqueNetworkId,
+			OpaqueNetworkType: summary.OpaqueNetworkType,
+		}, nil
+	}
+	return &types.VirtualEthernetCardNetworkBackingInfo{
+		VirtualDeviceDeviceBackingInfo: types.VirtualDeviceDeviceBackingInfo{
+			DeviceName: n.Name,
+		},
+		Network: &n.Self,
+	}, nil
+}
+
+// nicNetworkName returns the name of the network a nic is connected to.
+func nicNetworkName(ctx context.Context, dc *object.Datacenter, nic types.BaseVirtualDevice) (string, error) {
+	switch b := nic.GetVirtualDevice().Backing.(type) {
+	case *types.VirtualEthernetCardNetworkBackingInfo:
+		return b.DeviceName, nil
+	case *types.VirtualEthernetCardDistributedVirtualPortBackingInfo:
+		ref := types.ManagedObjectReference{Type: "DistributedVirtualPortgroup", Value: b.Port.PortgroupKey}
+		var pg mo.DistributedVirtualPortgroup
+		collector := property.DefaultCollector(dc.Client())
+		if err := collector.RetrieveOne(ctx, ref, []string{"name"}, &pg); err != nil {
+			return "", err
+		}
+		return pg.Name, nil
+	case *types.VirtualEthernetCardOpaqueNetworkBackingInfo:
+		networks, err := dcNetworks(ctx, dc)
+		if err != nil {
+			return "", err
+		}
+		for _, n := range networks {
+			if s, ok := n.Summary.(*types.OpaqueNetworkSummary); ok && s.OpaqueNetworkId == b.OpaqueNetworkId {
+				return n.Name, nil
+			}
+		}
+		return b.OpaqueNetworkId, nil
+	}
+	return "", nil
+}
+
+func networkNames(networks []mo.Network) string {
+	var names []string
+	for _, n := range networks {
+		names = append(names, n.Name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,49 @@
+package virtualmachine
+
+import (
+	"testing"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestValidMAC(t *testing.T) {
+	tests := []struct {
+		mac  string
+		want string
+	}{
+		{"00:50:56:00:00:01", ""},
+		{"00:50:56:3f:ff:ff", ""},
+		{"00-50-56-12-34-56", ""},
+		{"00:50:56:40:00:00", "outside the static range"},
+		{"00:0c:29:12:34:56", "outside the static range"},
+		{"00:50:56:00:00:00:00:01", "outside the static range"},
+		{"00:50:56:zz:00:01", "invalid MAC"},
+		{"", "invalid MAC"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mac, func(t *testing.T) {
+			checkErr(t, validMAC(tt.mac), tt.want)
+		})
+	}
+}
+
+func TestNewEthernetCard(t *testing.T) {
+	for _, adapterType := range []string{"e1000", "e1000e", "vmxnet2", "vmxnet3", "pcnet32", "sriov"} {
+		t.Run(adapterType, func(t *testing.T) {
+			card, err := newEthernetCard(adapterType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := adapterTypeOf(card.(types.BaseVirtualDevice)); got != adapterType {
+				t.Errorf("adapterTypeOf = %q", got)
+			}
+		})
+	}
+
+	card, err := newEthernetCard("")
+	if err != nil || adapterTypeOf(card.(types.BaseVirtualDevice)) != defaultAdapterType {
+		t.Errorf("empty adapterType made %T, %v", card, err)
+	}
+	_, err = newEthernetCard("ne2000")
+	checkErr(t, err, "Invalid network adapter type 'ne2000'")
+}
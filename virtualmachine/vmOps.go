@@ -0,0 +1,249 @@
+package virtualmachine
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/Masterminds/glide/msg"
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"golang.org/x/net/context"
+)
+
+// power operations accepted by PowerVMs
+const (
+	PowerOn    = "on"
+	PowerOff   = "off"
+	PowerReset = "reset"
+)
+
+// VMStatus is the inventory view of one vm printed by ls and status.
+type VMStatus struct {
+	Name         string
+	Path         string
+	PowerState   string
+	IPAddress    string
+	GuestID      string
+	ToolsRunning bool
+}
+
+// finder returns a finder scoped to the configured datacenter.
+func (c *Config) finder(ctx context.Context, client *govmomi.Client) (*find.Finder, error) {
+	dc, err := getDatacenter(ctx, client, c.Datacenter)
+	if err != nil {
+		return nil, newError(ErrUnknown, "", "get datacenter", err)
+	}
+	finder := find.NewFinder(client.Client, true)
+	return finder.SetDatacenter(dc), nil
+}
+
+// loadVMs reads the vms of the vmlist file or manifest at path. A vm that
+// names no datacenter goes to the configured one, so clone and ensure act
+// where ls and destroy look.
+func (c *Config) loadVMs(path string) ([]virtualMachine, error) {
+	vms, err := createVMObjs(path)
+	if err != nil {
+		return nil, err
+	}
+	for i := range vms {
+		if vms[i].datacenter == "" {
+			vms[i].datacenter = c.Datacenter
+		}
+	}
+	return vms, nil
+}
+
+// ListVMs returns the status of every vm matching pattern ("*" when empty).
+func ListVMs(ctx context.Context, c *Config, pattern string) ([]VMStatus, error) {
+	if pattern == "" {
+		pattern = "*"
+	}
+	client, err := c.Client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	finder, err := c.finder(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	vms, err := finder.VirtualMachineList(ctx, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return vmStatuses(ctx, client, vms)
+}
+
+// StatusVMs returns the status of the named vms.
+func StatusVMs(ctx context.Context, c *Config, names []string) ([]VMStatus, error) {
+	client, err := c.Client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	vms, err := c.findVMs(ctx, client, names)
+	if err != nil {
+		return nil, err
+	}
+	return vmStatuses(ctx, client, vms)
+}
+
+// PowerVMs runs the power operation op on every named vm.
+func PowerVMs(ctx context.Context, c *Config, op string, names []string) error {
+	client, err := c.Client(ctx)
+	if err != nil {
+		return err
+	}
+	vms, err := c.findVMs(ctx, client, names)
+	if err != nil {
+		return err
+	}
+
+	var failed int
+	for _, vm := range vms {
+		var task *object.Task
+		switch op {
+		case PowerOn:
+			task, err = vm.PowerOn(ctx)
+		case PowerOff:
+			task, err = vm.PowerOff(ctx)
+		case PowerReset:
+			task, err = vm.Reset(ctx)
+		default:
+			return fmt.Errorf("Invalid power operation '%s'", op)
+		}
+		if err == nil {
+			_, err = waitTask(ctx, task)
+		}
+		if err != nil {
+			msg.Err("power %s %s: %s", op, vm.InventoryPath, err)
+			failed++
+			continue
+		}
+		msg.Info("power %s %s", op, vm.InventoryPath)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d power operations failed", failed, len(vms))
+	}
+	return nil
+}
+
+// DestroyVMs powers off and deletes every named vm and releases the pool
+// addresses it leased.
+func DestroyVMs(ctx context.Context, c *Config, names []string) error {
+	client, err := c.Client(ctx)
+	if err != nil {
+		return err
+	}
+	vms, err := c.findVMs(ctx, client, names)
+	if err != nil {
+		return err
+	}
+
+	var failed int
+	var destroyed []string
+	for _, vm := range vms {
+		if err := destroyVM(ctx, vm); err != nil {
+			msg.Err("destroy %s: %s", vm.InventoryPath, err)
+			failed++
+			continue
+		}
+		msg.Info("destroyed %s", vm.InventoryPath)
+		destroyed = append(destroyed, path.Base(vm.InventoryPath))
+	}
+	// the pool addresses of the destroyed vms are free again
+	if err := releaseLeases(c.LeaseFile, destroyed); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d vms could not be destroyed", failed, len(vms))
+	}
+	return nil
+}
+
+// destroyVM powers off vm if needed and removes it from disk.
+func destroyVM(ctx context.Context, vm *object.VirtualMachine) error {
+	state, err := vm.PowerState(ctx)
+	if err != nil {
+		return err
+	}
+	if state == types.VirtualMachinePowerStatePoweredOn {
+		task, err := vm.PowerOff(ctx)
+		if err != nil {
+			return err
+		}
+		if _, err = waitTask(ctx, task); err != nil {
+			return err
+		}
+	}
+
+	task, err := vm.Destroy(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = waitTask(ctx, task)
+	return err
+}
+
+// findVMs resolves every name (or folder/name path) to a vm.
+func (c *Config) findVMs(ctx context.Context, client *govmomi.Client, names []string) ([]*object.VirtualMachine, error) {
+	if len(names) == 0 {
+		return nil, fmt.Errorf("No vm name given")
+	}
+	finder, err := c.finder(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	var vms []*object.VirtualMachine
+	for _, name := range names {
+		vm, err := finder.VirtualMachine(ctx, name)
+		if err != nil {
+			return nil, newError(ErrUnknown, name, "find vm", err)
+		}
+		vms = append(vms, vm)
+	}
+	return vms, nil
+}
+
+// vmStatuses fetches power and guest state of vms in one round trip.
+func vmStatuses(ctx context.Context, client *govmomi.Client, vms []*object.VirtualMachine) ([]VMStatus, error) {
+	if len(vms) == 0 {
+		return nil, nil
+	}
+	refs := make([]types.ManagedObjectReference, 0, len(vms))
+	for _, vm := range vms {
+		refs = append(refs, vm.Reference())
+	}
+
+	var mvms []mo.VirtualMachine
+	collector := property.DefaultCollector(client.Client)
+	err := collector.Retrieve(ctx, refs, []string{"name", "runtime.powerState", "guest"}, &mvms)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make(map[types.ManagedObjectReference]string)
+	for _, vm := range vms {
+		paths[vm.Reference()] = vm.InventoryPath
+	}
+
+	statuses := make([]VMStatus, 0, len(mvms))
+	for _, mvm := range mvms {
+		s := VMStatus{
+			Name:       mvm.Name,
+			Path:       paths[mvm.Reference()],
+			PowerState: string(mvm.Runtime.PowerState),
+		}
+		if mvm.Guest != nil {
+			s.IPAddress = mvm.Guest.IpAddress
+			s.GuestID = mvm.Guest.GuestId
+			s.ToolsRunning = mvm.Guest.ToolsRunningStatus == string(types.VirtualMachineToolsRunningStatusGuestToolsRunning)
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses, nil
+}
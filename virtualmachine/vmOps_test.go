@@ -0,0 +1,38 @@
+package virtualmachine
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLoadVMsDatacenter(t *testing.T) {
+	manifest := "defaults:\n  template: tlp\n  datastore: ds1\n  networkInterfaces:\n    - label: VM Network\nvms:\n  - name: a\n  - name: b\n    datacenter: DC3\n"
+	tests := []struct {
+		name       string
+		file       string
+		content    string
+		datacenter string
+		want       []string
+	}{
+		{"flag fills the manifest", "vms.yaml", manifest, "DC2", []string{"DC2", "DC3"}},
+		{"no flag", "vms.yaml", manifest, "", []string{"", "DC3"}},
+		{"flag fills the vmlist", "vmlist", "10.10.10.21 a h1 ds1 tlp 10.10.10.1\n", "DC2", []string{"DC2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, cleanup := writeManifest(t, tt.file, tt.content)
+			defer cleanup()
+			vms, err := (&Config{Datacenter: tt.datacenter}).loadVMs(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, vm := range vms {
+				got = append(got, vm.datacenter)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("datacenters %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package virtualmachine
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+const defaultParallel = 4
+
+// CloneOptions tunes a batch clone.
+type CloneOptions struct {
+	// Parallel is the number of clones in flight, defaultParallel when 0.
+	Parallel int
+	// PerDatastore and PerHost cap the clones in flight against one
+	// datastore, of the vm or any of its disks, or one host, 0 means no
+	// cap. A vm without a host counts once it is placed on one; vms drs
+	// places are not capped, drs spreads them itself.
+	PerDatastore int
+	PerHost      int
+	// Timeouts bounds every phase of each clone.
+	Timeouts Timeouts
+	// KeepOnFailure leaves the vm of a failed clone in place for
+	// debugging instead of destroying it.
+	KeepOnFailure bool
+	// Ensure reconciles vms that already exist against the spec instead
+	// of failing on them; Plan only reports what Ensure would do.
+	Ensure bool
+	Plan   bool
+	// Restart lets Ensure power off a running vm for the vcpu and memory
+	// changes its hot plug settings do not allow.
+	Restart bool
+}
+
+// pool runs jobs on a fixed number of workers. A job starts only while
+// its datastores and named host are under their caps; jobs are taken in
+// queue order, skipping over blocked ones, so one busy datastore never
+// holds back vms bound elsewhere. A job placed on a host once running
+// waits for that host with claimHost.
+type pool struct {
+	ctx     context.Context
+	opts    CloneOptions
+	vms     []virtualMachine
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []int
+	byDS    map[string]int
+	byHost  map[string]int
+	placed  map[int]string // host claimed by a running job
+}
+
+// claimHostFunc waits until host is under its cap and counts the calling
+// job against it until the job is done.
+type claimHostFunc func(ctx context.Context, host string) error
+
+// runPool calls fn with the index of every vm and returns once all are
+// done. Once ctx is cancelled no more jobs start; the indexes of those
+// are returned.
+func runPool(ctx context.Context, vms []virtualMachine, opts CloneOptions, fn func(i int, claimHost claimHostFunc)) []int {
+	if opts.Parallel <= 0 {
+		opts.Parallel = defaultParallel
+	}
+	p := &pool{
+		ctx:    ctx,
+		opts:   opts,
+		vms:    vms,
+		byDS:   make(map[string]int),
+		byHost: make(map[string]int),
+		placed: make(map[int]string),
+	}
+	p.cond = sync.NewCond(&p.mu)
+	for i := range vms {
+		p.pending = append(p.pending, i)
+	}
+	defer p.wakeOn(ctx)()
+
+	var wg sync.WaitGroup
+	for w := 0; w < opts.Parallel && w < len(vms); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i, ok := p.next()
+				if !ok {
+					return
+				}
+				fn(i, func(ctx context.Context, host string) error {
+					return p.claimHost(ctx, i, host)
+				})
+				p.done(i)
+			}
+		}()
+	}
+	wg.Wait()
+	return p.pending
+}
+
+// next blocks until a pending job may start and claims it. It returns
+// false once the queue is empty or the run is cancelled.
+func (p *pool) next() (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		if len(p.pending) == 0 || p.ctx.Err() != nil {
+			return 0, false
+		}
+		for n, i := range p.pending {
+			if p.allowed(&p.vms[i]) {
+				p.pending = append(p.pending[:n], p.pending[n+1:]...)
+				p.acquire(&p.vms[i], 1)
+				return i, true
+			}
+		}
+		p.cond.Wait()
+	}
+}
+
+// claimHost blocks until host is under its cap and counts job i against
+// it. It returns the ctx error when ctx ends first. A job with a named
+// host holds it from the start already.
+func (p *pool) claimHost(ctx context.Context, i int, host string) error {
+	if p.vms[i].host != "" {
+		return nil
+	}
+	defer p.wakeOn(ctx)()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.opts.PerHost > 0 && p.byHost[host] >= p.opts.PerHost {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		p.cond.Wait()
+	}
+	p.byHost[host]++
+	p.placed[i] = host
+	return nil
+}
+
+// wakeOn wakes the jobs waiting for a cap when ctx ends, until the
+// returned stop is called.
+func (p *pool) wakeOn(ctx context.Context) (stop func()) {
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.mu.Lock()
+			p.cond.Broadcast()
+			p.mu.Unlock()
+		case <-finished:
+		}
+	}()
+	return func() { close(finished) }
+}
+
+// done releases the caps held by job i.
+func (p *pool) done(i int) {
+	p.mu.Lock()
+	p.acquire(&p.vms[i], -1)
+	if host, ok := p.placed[i]; ok {
+		p.byHost[host]--
+		delete(p.placed, i)
+	}
+	p.mu.Unlock()
+	p.cond.Broadcast()
+}
+
+func (p *pool) allowed(vm *virtualMachine) bool {
+	if p.opts.PerDatastore > 0 {
+		for _, ds := range vm.datastores() {
+			if p.byDS[ds] >= p.opts.PerDatastore {
+				return false
+			}
+		}
+	}
+	if p.opts.PerHost > 0 && vm.host != "" && p.byHost[vm.host] >= p.opts.PerHost {
+		return false
+	}
+	return true
+}
+
+func (p *pool) acquire(vm *virtualMachine, n int) {
+	for _, ds := range vm.datastores() {
+		p.byDS[ds] += n
+	}
+	if vm.host != "" {
+		p.byHost[vm.host] += n
+	}
+}
+
+// datastores returns the named datastores the clone of vm writes to, its
+// own and those of its disks, each once.
+func (vm *virtualMachine) datastores() []string {
+	var names []string
+	seen := map[string]bool{"": true}
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	add(vm.datastore)
+	for _, hd := range vm.hardDisks {
+		add(hd.datastore)
+	}
+	return names
+}
@@ -0,0 +1,173 @@
+package virtualmachine
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// inFlight counts the jobs running per key and keeps the peak of each.
+type inFlight struct {
+	mu   sync.Mutex
+	now  map[string]int
+	peak map[string]int
+}
+
+func newInFlight() *inFlight {
+	return &inFlight{now: make(map[string]int), peak: make(map[string]int)}
+}
+
+func (f *inFlight) add(key string, n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now[key] += n
+	if f.now[key] > f.peak[key] {
+		f.peak[key] = f.now[key]
+	}
+}
+
+func TestRunPoolCaps(t *testing.T) {
+	tests := []struct {
+		name string
+		opts CloneOptions
+		vms  []virtualMachine
+		peak map[string]int // by datastore or host
+	}{
+		{
+			"datastore cap",
+			CloneOptions{Parallel: 4, PerDatastore: 1},
+			[]virtualMachine{{datastore: "ds1"}, {datastore: "ds1"}, {datastore: "ds2"}, {datastore: "ds2"}},
+			map[string]int{"ds1": 1, "ds2": 1},
+		},
+		{
+			"disk datastores count",
+			CloneOptions{Parallel: 4, PerDatastore: 1},
+			[]virtualMachine{
+				{datastore: "ds1", hardDisks: []hardDisk{{}, {datastore: "ds2"}}},
+				{datastore: "ds2"},
+				{datastore: "ds3", hardDisks: []hardDisk{{datastore: "ds1"}}},
+			},
+			map[string]int{"ds1": 1, "ds2": 1, "ds3": 1},
+		},
+		{
+			"named host cap",
+			CloneOptions{Parallel: 4, PerHost: 2},
+			[]virtualMachine{{host: "h1"}, {host: "h1"}, {host: "h1"}, {host: "h1"}, {host: "h2"}},
+			map[string]int{"h1": 2, "h2": 1},
+		},
+		{
+			"no caps",
+			CloneOptions{Parallel: 3},
+			[]virtualMachine{{datastore: "ds1"}, {datastore: "ds1"}, {datastore: "ds1"}},
+			map[string]int{"ds1": 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newInFlight()
+			var started sync.WaitGroup
+			started.Add(len(tt.vms))
+			pending := runPool(context.Background(), tt.vms, tt.opts, func(i int, claimHost claimHostFunc) {
+				vm := &tt.vms[i]
+				keys := vm.datastores()
+				if vm.host != "" {
+					keys = append(keys, vm.host)
+				}
+				for _, k := range keys {
+					f.add(k, 1)
+				}
+				time.Sleep(10 * time.Millisecond)
+				for _, k := range keys {
+					f.add(k, -1)
+				}
+			})
+			if len(pending) != 0 {
+				t.Errorf("pending %v", pending)
+			}
+			if !reflect.DeepEqual(f.peak, tt.peak) {
+				t.Errorf("peak %v, want %v", f.peak, tt.peak)
+			}
+		})
+	}
+}
+
+func TestRunPoolClaimHost(t *testing.T) {
+	// placed by load, all on one host
+	vms := make([]virtualMachine, 4)
+	f := newInFlight()
+	runPool(context.Background(), vms, CloneOptions{Parallel: 4, PerHost: 1}, func(i int, claimHost claimHostFunc) {
+		if err := claimHost(context.Background(), "h1"); err != nil {
+			t.Error(err)
+			return
+		}
+		f.add("h1", 1)
+		time.Sleep(10 * time.Millisecond)
+		f.add("h1", -1)
+	})
+	if f.peak["h1"] != 1 {
+		t.Errorf("peak on h1 %d, want 1", f.peak["h1"])
+	}
+}
+
+func TestClaimHostCanceled(t *testing.T) {
+	vms := make([]virtualMachine, 2)
+	hold := make(chan struct{})
+	errs := make(chan error, 2)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(hold)
+	}()
+	runPool(context.Background(), vms, CloneOptions{Parallel: 2, PerHost: 1}, func(i int, claimHost claimHostFunc) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+		defer cancel()
+		err := claimHost(ctx, "h1")
+		errs <- err
+		if err == nil {
+			<-hold
+		}
+	})
+	close(errs)
+	var got []error
+	for err := range errs {
+		got = append(got, err)
+	}
+	if len(got) != 2 || (got[0] == nil) == (got[1] == nil) {
+		t.Errorf("want one claim and one timeout, got %v", got)
+	}
+}
+
+func TestRunPoolCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	vms := []virtualMachine{{datastore: "ds1"}, {datastore: "ds1"}, {datastore: "ds1"}}
+	var ran []int
+	pending := runPool(ctx, vms, CloneOptions{Parallel: 1}, func(i int, claimHost claimHostFunc) {
+		ran = append(ran, i)
+		cancel()
+	})
+	if !reflect.DeepEqual(ran, []int{0}) || !reflect.DeepEqual(pending, []int{1, 2}) {
+		t.Errorf("ran %v and left %v, want [0] and [1 2]", ran, pending)
+	}
+}
+
+func TestDatastores(t *testing.T) {
+	tests := []struct {
+		name string
+		vm   virtualMachine
+		want []string
+	}{
+		{"none", virtualMachine{}, nil},
+		{"vm", virtualMachine{datastore: "ds1"}, []string{"ds1"}},
+		{"disks", virtualMachine{datastore: "ds1", hardDisks: []hardDisk{{}, {datastore: "ds2"}, {datastore: "ds1"}}}, []string{"ds1", "ds2"}},
+		{"disks only", virtualMachine{hardDisks: []hardDisk{{datastore: "ds2"}}}, []string{"ds2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.vm.datastores(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
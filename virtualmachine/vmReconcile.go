@@ -0,0 +1,417 @@
+package virtualmachine
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Masterminds/glide/msg"
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"golang.org/x/net/context"
+)
+
+// results of an ensure run, see CloneResult.Action
+const (
+	ActionCreated   = "created"
+	ActionUpdated   = "updated"
+	ActionUnchanged = "unchanged"
+	ActionPlanned   = "planned"
+)
+
+// vmDrift is one difference between the spec and an existing vm. apply is
+// nil when the difference cannot be fixed in place, offline is set when
+// it can only be fixed while the vm is powered off.
+type vmDrift struct {
+	what    string
+	have    string
+	want    string
+	apply   func(ctx context.Context) error
+	offline bool
+}
+
+func (d vmDrift) String() string {
+	s := fmt.Sprintf("%s: have %s, want %s", d.what, d.have, d.want)
+	switch {
+	case d.apply == nil && d.offline:
+		s += " (needs a power off, use --restart or enable hot add)"
+	case d.apply == nil:
+		s += " (not fixable in place)"
+	}
+	return s
+}
+
+// hotPlug is what the running vm can change without a power off.
+type hotPlug struct {
+	cpuAdd, cpuRemove, memoryAdd bool
+}
+
+// findExisting returns the vm at vm.Path(), nil when there is none, and
+// the datacenter it belongs in.
+func (vm *virtualMachine) findExisting(ctx context.Context, c *govmomi.Client) (*object.VirtualMachine, *object.Datacenter, error) {
+	dc, err := getDatacenter(ctx, c, vm.datacenter)
+	if err != nil {
+		return nil, nil, newError(ErrUnknown, vm.name, "get datacenter", err)
+	}
+	finder := find.NewFinder(c.Client, true)
+	finder = finder.SetDatacenter(dc)
+
+	existing, err := finder.VirtualMachine(ctx, vm.Path())
+	if err != nil {
+		if _, ok := err.(*find.NotFoundError); ok {
+			return nil, dc, nil
+		}
+		return nil, nil, newError(ErrUnknown, vm.name, "find existing vm", err)
+	}
+	return existing, dc, nil
+}
+
+// drift compares an existing vm against the spec. With restart a
+// running vm is powered off for the changes it cannot take online and
+// powered on again after them.
+func (vm *virtualMachine) drift(ctx context.Context, dc *object.Datacenter, existing *object.VirtualMachine, restart bool) ([]vmDrift, error) {
+	var mvm mo.VirtualMachine
+	err := existing.Properties(ctx, existing.Reference(), []string{"config.hardware", "config.cpuHotAddEnabled", "config.cpuHotRemoveEnabled", "config.memoryHotAddEnabled", "runtime.powerState"}, &mvm)
+	if err != nil {
+		return nil, newError(ErrUnknown, vm.name, "get vm config", err)
+	}
+	hw := mvm.Config.Hardware
+	devices := object.VirtualDeviceList(hw.Device)
+	if err := knownDevices(devices); err != nil {
+		return nil, newError(ErrInvalidSpec, vm.name, "get vm devices", err)
+	}
+	running := mvm.Runtime.PowerState == types.VirtualMachinePowerStatePoweredOn
+	hot := hotPlug{
+		cpuAdd:    isTrue(mvm.Config.CpuHotAddEnabled),
+		cpuRemove: isTrue(mvm.Config.CpuHotRemoveEnabled),
+		memoryAdd: isTrue(mvm.Config.MemoryHotAddEnabled),
+	}
+
+	var drifts []vmDrift
+	var cycled []string
+	for _, d := range vm.sizeDrift(existing, hw, running, hot) {
+		if d.offline {
+			if !restart {
+				d.apply = nil
+			}
+			cycled = append(cycled, d.what)
+		}
+		drifts = append(drifts, d)
+	}
+	if restart && len(cycled) > 0 {
+		off := vmDrift{
+			what: "power",
+			have: string(types.VirtualMachinePowerStatePoweredOn),
+			want: fmt.Sprintf("%s to change %s", types.VirtualMachinePowerStatePoweredOff, strings.Join(cycled, ", ")),
+			apply: func(ctx context.Context) error {
+				task, err := existing.PowerOff(ctx)
+				if err != nil {
+					return err
+				}
+				_, err = waitTask(ctx, task)
+				return err
+			},
+		}
+		drifts = append([]vmDrift{off}, drifts...)
+	}
+
+	nicDrifts, err := vm.nicDrift(ctx, dc, existing, devices)
+	if err != nil {
+		return nil, err
+	}
+	drifts = append(drifts, nicDrifts...)
+	drifts = append(drifts, vm.diskDrift(existing, devices)...)
+
+	switch {
+	case restart && len(cycled) > 0:
+		drifts = append(drifts, vmDrift{
+			what: "power",
+			have: string(types.VirtualMachinePowerStatePoweredOff) + " after the changes",
+			want: string(types.VirtualMachinePowerStatePoweredOn),
+			apply: func(ctx context.Context) error {
+				return vm.powerOnVM(ctx, existing)
+			},
+		})
+	case !running:
+		drifts = append(drifts, vmDrift{
+			what: "power",
+			have: string(mvm.Runtime.PowerState),
+			want: string(types.VirtualMachinePowerStatePoweredOn),
+			apply: func(ctx context.Context) error {
+				return vm.powerOnVM(ctx, existing)
+			},
+		})
+	}
+	return drifts, nil
+}
+
+// sizeDrift compares vcpu and memoryMb. A running vm only takes the
+// changes its hot plug settings allow; the others are marked offline.
+func (vm *virtualMachine) sizeDrift(existing *object.VirtualMachine, hw types.VirtualHardware, running bool, hot hotPlug) []vmDrift {
+	var drifts []vmDrift
+	if vm.vcpu != 0 && hw.NumCPU != vm.vcpu {
+		online := hot.cpuAdd
+		if vm.vcpu < hw.NumCPU {
+			online = hot.cpuRemove
+		}
+		drifts = append(drifts, vmDrift{
+			what:    "vcpu",
+			have:    fmt.Sprint(hw.NumCPU),
+			want:    fmt.Sprint(vm.vcpu),
+			offline: running && !online,
+			apply: func(ctx context.Context) error {
+				return reconfigure(ctx, existing, types.VirtualMachineConfigSpec{NumCPUs: vm.vcpu})
+			},
+		})
+	}
+	if vm.memoryMb != 0 && int64(hw.MemoryMB) != vm.memoryMb {
+		// memory never shrinks while running
+		online := hot.memoryAdd && vm.memoryMb > int64(hw.MemoryMB)
+		drifts = append(drifts, vmDrift{
+			what:    "memoryMb",
+			have:    fmt.Sprint(hw.MemoryMB),
+			want:    fmt.Sprint(vm.memoryMb),
+			offline: running && !online,
+			apply: func(ctx context.Context) error {
+				return reconfigure(ctx, existing, types.VirtualMachineConfigSpec{MemoryMB: vm.memoryMb})
+			},
+		})
+	}
+	return drifts
+}
+
+func isTrue(b *bool) bool {
+	return b != nil && *b
+}
+
+// nicDrift compares the nics by position: count, adapter type and
+// network. A vm cloned with the keep policy has the nics of its template
+// whatever it declares, so it never drifts.
+func (vm *virtualMachine) nicDrift(ctx context.Context, dc *object.Datacenter, existing *object.VirtualMachine, devices object.VirtualDeviceList) ([]vmDrift, error) {
+	if vm.nicPolicy == nicPolicyKeep {
+		return nil, nil
+	}
+	var drifts []vmDrift
+	nics := devices.SelectByType((*types.VirtualEthernetCard)(nil))
+
+	for i, network := range vm.networkInterfaces {
+		network := network
+		if i >= len(nics) {
+			drifts = append(drifts, vmDrift{
+				what: fmt.Sprintf("networkInterfaces[%d]", i),
+				have: "none",
+				want: "nic on " + labelOrDefault(network.label),
+				apply: func(ctx context.Context) error {
+					nd, err := buildNetworkDevice(ctx, dc, network, -1)
+					if err != nil {
+						return err
+					}
+					return changeDevices(ctx, existing, types.VirtualDeviceConfigSpecOperationAdd, nd.Device)
+				},
+			})
+			continue
+		}
+		nic := nics[i]
+		// an empty adapterType takes any
+		want := network.adapterType
+		if have := adapterTypeOf(nic); want != "" && have != want {
+			// the adapter type of a nic cannot be changed in place
+			drifts = append(drifts, vmDrift{
+				what: fmt.Sprintf("networkInterfaces[%d].adapterType", i),
+				have: have,
+				want: want,
+			})
+		}
+		if network.label == "" {
+			continue
+		}
+
+		have, err := nicNetworkName(ctx, dc, nic)
+		if err != nil {
+			return nil, newError(ErrUnknown, vm.name, "get nic network", err)
+		}
+		if have == network.label {
+			continue
+		}
+		drifts = append(drifts, vmDrift{
+			what: fmt.Sprintf("networkInterfaces[%d].label", i),
+			have: have,
+			want: network.label,
+			apply: func(ctx context.Context) error {
+				nd, err := buildNetworkDevice(ctx, dc, network, -1)
+				if err != nil {
+					return err
+				}
+				nic.GetVirtualDevice().Backing = nd.Device.GetVirtualDevice().Backing
+				return changeDevices(ctx, existing, types.VirtualDeviceConfigSpecOperationEdit, nic)
+			},
+		})
+	}
+
+	for i := len(vm.networkInterfaces); i < len(nics); i++ {
+		nic := nics[i]
+		drifts = append(drifts, vmDrift{
+			what: fmt.Sprintf("networkInterfaces[%d]", i),
+			have: devices.Name(nic),
+			want: "none",
+			apply: func(ctx context.Context) error {
+				return changeDevices(ctx, existing, types.VirtualDeviceConfigSpecOperationRemove, nic)
+			},
+		})
+	}
+	return drifts, nil
+}
+
+// diskDrift compares disk sizes by position and adds missing extra disks.
+// Disks are never shrunk or removed.
+func (vm *virtualMachine) diskDrift(existing *object.VirtualMachine, devices object.VirtualDeviceList) []vmDrift {
+	var drifts []vmDrift
+	disks := devices.SelectByType((*types.VirtualDisk)(nil))
+
+	for i, hd := range vm.hardDisks {
+		hd := hd
+		if i >= len(disks) {
+			if i == 0 || hd.size == 0 {
+				continue
+			}
+			drifts = append(drifts, vmDrift{
+				what: fmt.Sprintf("hardDisks[%d]", i),
+				have: "none",
+				want: fmt.Sprintf("%dGB", hd.size),
+				apply: func(ctx context.Context) error {
+					ds, err := vm.diskDatastore(ctx, existing, hd)
+					if err != nil {
+						return err
+					}
+					return addHardDisk(ctx, existing, hd, ds)
+				},
+			})
+			continue
+		}
+		if hd.size == 0 {
+			continue
+		}
+
+		disk := disks[i].(*types.VirtualDisk)
+		want := hd.size * 1024 * 1024
+		if disk.CapacityInKB == want {
+			continue
+		}
+		d := vmDrift{
+			what: fmt.Sprintf("hardDisks[%d].size", i),
+			have: fmt.Sprintf("%dGB", disk.CapacityInKB/1024/1024),
+			want: fmt.Sprintf("%dGB", hd.size),
+		}
+		if disk.CapacityInKB < want {
+			d.apply = func(ctx context.Context) error {
+				disk.CapacityInKB = want
+				return changeDevices(ctx, existing, types.VirtualDeviceConfigSpecOperationEdit, disk)
+			}
+		}
+		drifts = append(drifts, d)
+	}
+	return drifts
+}
+
+// reconcile applies drifts in order and stops at the first failure.
+func (vm *virtualMachine) reconcile(ctx context.Context, drifts []vmDrift) error {
+	for _, d := range drifts {
+		if d.apply == nil {
+			return newError(ErrInvalidSpec, vm.name, "reconcile", fmt.Errorf("%s", d))
+		}
+		msg.Info("vm %s: fixing %s", vm.name, d)
+		if err := d.apply(ctx); err != nil {
+			return newError(ErrUnknown, vm.name, "reconcile "+d.what, err)
+		}
+	}
+	return nil
+}
+
+func reconfigure(ctx context.Context, vm *object.VirtualMachine, spec types.VirtualMachineConfigSpec) error {
+	task, err := vm.Reconfigure(ctx, spec)
+	if err != nil {
+		return err
+	}
+	_, err = waitTask(ctx, task)
+	return err
+}
+
+// vmDatastore returns the first datastore of vm.
+func vmDatastore(ctx context.Context, vm *object.VirtualMachine) (*object.Datastore, error) {
+	var mvm mo.VirtualMachine
+	if err := vm.Properties(ctx, vm.Reference(), []string{"datastore"}, &mvm); err != nil {
+		return nil, err
+	}
+	if len(mvm.Datastore) == 0 {
+		return nil, fmt.Errorf("vm has no datastore")
+	}
+	return object.NewDatastore(vm.Client(), mvm.Datastore[0]), nil
+}
+
+func labelOrDefault(label string) string {
+	if label == "" {
+		return "default network"
+	}
+	return label
+}
+
+// ensure clones vm when it does not exist yet and reconciles it otherwise.
+func ensure(ctx context.Context, vmObj *virtualMachine, client *govmomi.Client, auth *types.NamePasswordAuthentication, opts CloneOptions, claimHost claimHostFunc, placed *placedMemory) CloneResult {
+	existing, dc, err := vmObj.findExisting(ctx, client)
+	if err != nil {
+		r := newCloneResult(vmObj)
+		r.phase("compare", func() error { return err })
+		r.finish()
+		return *r
+	}
+	if existing != nil {
+		return ensureWorker(ctx, vmObj, client, dc, existing, opts)
+	}
+	if opts.Plan {
+		r := newCloneResult(vmObj)
+		r.Action = ActionPlanned
+		r.Drift = []string{"vm: have none, want clone of " + vmObj.template}
+		r.finish()
+		return *r
+	}
+	return worker(ctx, vmObj, client, auth, opts, claimHost, placed)
+}
+
+// ensureWorker reconciles an existing vm, or only reports its drift when
+// opts.Plan is set.
+func ensureWorker(ctx context.Context, vmObj *virtualMachine, client *govmomi.Client, dc *object.Datacenter, existing *object.VirtualMachine, opts CloneOptions) CloneResult {
+	r := newCloneResult(vmObj)
+	r.MoRef = existing.Reference().Value
+
+	var drifts []vmDrift
+	err := r.phase("compare", func() (err error) {
+		drifts, err = vmObj.drift(ctx, dc, existing, opts.Restart)
+		return err
+	})
+	for _, d := range drifts {
+		r.Drift = append(r.Drift, d.String())
+	}
+
+	switch {
+	case err != nil:
+	case len(drifts) == 0:
+		r.Action = ActionUnchanged
+	case opts.Plan:
+		r.Action = ActionPlanned
+	default:
+		err = r.phase("reconcile", func() error {
+			return vmObj.reconcile(ctx, drifts)
+		})
+		if err == nil {
+			r.Action = ActionUpdated
+		}
+	}
+
+	if state, err := existing.PowerState(ctx); err == nil {
+		r.PowerState = string(state)
+	}
+	r.finish()
+	return *r
+}
@@ -0,0 +1,123 @@
+package virtualmachine
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/types"
+	"golang.org/x/net/context"
+)
+
+func TestSizeDrift(t *testing.T) {
+	hw := types.VirtualHardware{NumCPU: 2, MemoryMB: 4096}
+	tests := []struct {
+		name    string
+		vcpu    int
+		memory  int64
+		running bool
+		hot     hotPlug
+		want    []string // what of each drift, offline ones with a *
+	}{
+		{"unchanged", 2, 4096, true, hotPlug{}, nil},
+		{"unset", 0, 0, true, hotPlug{}, nil},
+		{"powered off", 4, 8192, false, hotPlug{}, []string{"vcpu", "memoryMb"}},
+		{"running without hot add", 4, 8192, true, hotPlug{}, []string{"vcpu*", "memoryMb*"}},
+		{"running with hot add", 4, 8192, true, hotPlug{cpuAdd: true, memoryAdd: true}, []string{"vcpu", "memoryMb"}},
+		{"cpu remove needs hot remove", 1, 4096, true, hotPlug{cpuAdd: true}, []string{"vcpu*"}},
+		{"cpu remove with hot remove", 1, 4096, true, hotPlug{cpuRemove: true}, []string{"vcpu"}},
+		{"memory never shrinks running", 2, 2048, true, hotPlug{memoryAdd: true}, []string{"memoryMb*"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := &virtualMachine{name: "vm", vcpu: tt.vcpu, memoryMb: tt.memory}
+			var got []string
+			for _, d := range vm.sizeDrift(nil, hw, tt.running, tt.hot) {
+				if d.apply == nil {
+					t.Errorf("%s: apply is nil", d.what)
+				}
+				what := d.what
+				if d.offline {
+					what += "*"
+				}
+				got = append(got, what)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("drifts %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDriftString(t *testing.T) {
+	d := vmDrift{what: "vcpu", have: "2", want: "4"}
+	if got := d.String(); got != "vcpu: have 2, want 4 (not fixable in place)" {
+		t.Errorf("got %q", got)
+	}
+	d.offline = true
+	if got := d.String(); !strings.Contains(got, "--restart") {
+		t.Errorf("offline drift %q does not mention --restart", got)
+	}
+}
+
+func TestNICAdapterDrift(t *testing.T) {
+	devices := object.VirtualDeviceList{&types.VirtualE1000e{}}
+	tests := []struct {
+		name        string
+		policy      string
+		adapterType string
+		drift       bool
+	}{
+		{"any adapter", nicPolicyReplace, "", false},
+		{"same adapter", nicPolicyEdit, "e1000e", false},
+		{"other adapter", nicPolicyEdit, "vmxnet3", true},
+		{"keep takes the template nic", nicPolicyKeep, "vmxnet3", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := &virtualMachine{
+				name:              "vm",
+				nicPolicy:         tt.policy,
+				networkInterfaces: []networkInterface{{adapterType: tt.adapterType}},
+			}
+			drifts, err := vm.nicDrift(context.Background(), nil, nil, devices)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := len(drifts) > 0; got != tt.drift {
+				t.Errorf("drift %v, want %v: %v", got, tt.drift, drifts)
+			}
+		})
+	}
+}
+
+func TestNICCountDrift(t *testing.T) {
+	devices := object.VirtualDeviceList{&types.VirtualVmxnet3{}, &types.VirtualVmxnet3{}, &types.VirtualE1000e{}}
+	tests := []struct {
+		name   string
+		policy string
+		nics   []networkInterface
+		want   []string
+	}{
+		{"edit removes the extra template nics", nicPolicyEdit, []networkInterface{{}}, []string{"networkInterfaces[1]", "networkInterfaces[2]"}},
+		{"keep leaves the template nics", nicPolicyKeep, []networkInterface{{label: "VM Network", adapterType: "e1000"}}, nil},
+		{"keep ignores missing nics", nicPolicyKeep, make([]networkInterface, 4), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := &virtualMachine{name: "vm", nicPolicy: tt.policy, networkInterfaces: tt.nics}
+			drifts, err := vm.nicDrift(context.Background(), nil, nil, devices)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, d := range drifts {
+				got = append(got, d.what)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("drift %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
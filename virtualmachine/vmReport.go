@@ -0,0 +1,171 @@
+package virtualmachine
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// report formats accepted by WriteReport
+const (
+	ReportJSON = "json"
+	ReportCSV  = "csv"
+)
+
+// Phase is the timing of one step of a clone.
+type Phase struct {
+	Name     string        `json:"name"`
+	Duration time.Duration `json:"-"`
+	Seconds  float64       `json:"seconds"`
+}
+
+// CloneResult is the outcome of cloning one vm.
+type CloneResult struct {
+	Name        string        `json:"name"`
+	IP          string        `json:"ip"`
+	Template    string        `json:"template"`
+	Host        string        `json:"host"`
+	Datastore   string        `json:"datastore"`
+	MoRef       string        `json:"moref"`
+	PowerState  string        `json:"powerState"`
+	Phases      []Phase       `json:"phases"`
+	Duration    time.Duration `json:"-"`
+	Seconds     float64       `json:"seconds"`
+	FailedPhase string        `json:"failedPhase,omitempty"`
+	ErrorKind   string        `json:"errorKind,omitempty"`
+	Error       string        `json:"error,omitempty"`
+	// RolledBack is set when the vm of a failed clone was destroyed,
+	// RollbackError when that did not work either.
+	RolledBack    bool   `json:"rolledBack,omitempty"`
+	RollbackError string `json:"rollbackError,omitempty"`
+	// Action tells what was done to the vm, Drift lists the differences an
+	// ensure run found on an existing vm.
+	Action string   `json:"action,omitempty"`
+	Drift  []string `json:"drift,omitempty"`
+
+	start time.Time
+}
+
+func newCloneResult(vm *virtualMachine) *CloneResult {
+	return &CloneResult{
+		Name:      vm.name,
+		IP:        vm.IPAddr(),
+		Template:  vm.template,
+		Host:      vm.host,
+		Datastore: vm.datastore,
+		start:     time.Now(),
+	}
+}
+
+// finish records the total time taken.
+func (r *CloneResult) finish() {
+	r.Duration = time.Since(r.start)
+	r.Seconds = r.Duration.Seconds()
+}
+
+// phase runs fn as the named step and records how long it took. A failed
+// step is recorded as the failed phase of the result.
+func (r *CloneResult) phase(name string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	r.addPhase(name, time.Since(start))
+	if err != nil {
+		r.FailedPhase = name
+		r.ErrorKind = Kind(err).String()
+		r.Error = err.Error()
+	}
+	return err
+}
+
+func (r *CloneResult) addPhase(name string, d time.Duration) {
+	r.Phases = append(r.Phases, Phase{Name: name, Duration: d, Seconds: d.Seconds()})
+}
+
+// Failed reports whether the clone did not complete.
+func (r *CloneResult) Failed() bool {
+	return r.Error != ""
+}
+
+func (r *CloneResult) status() string {
+	switch {
+	case r.RolledBack:
+		return "rolled back"
+	case r.Failed():
+		return "failed"
+	case r.Action != "":
+		return r.Action
+	}
+	return "ok"
+}
+
+// WriteSummary prints results as a table for people.
+func WriteSummary(w io.Writer, results []CloneResult) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tIP\tHOST\tDATASTORE\tMOREF\tPOWER\tTIME\tSTATUS")
+	var failed int
+	for _, r := range results {
+		status := r.status()
+		if r.Failed() {
+			failed++
+			status += " (" + r.FailedPhase + ")"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			r.Name, r.IP, r.Host, r.Datastore, r.MoRef, r.PowerState,
+			r.Duration.Round(time.Second), status)
+	}
+	fmt.Fprintf(tw, "\n%d ok, %d failed\n", len(results)-failed, failed)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	for _, r := range results {
+		if r.Failed() {
+			fmt.Fprintf(w, "%s: %s\n", r.Name, r.Error)
+		}
+		if r.RollbackError != "" {
+			fmt.Fprintf(w, "%s: left behind: %s\n", r.Name, r.RollbackError)
+		}
+		for _, d := range r.Drift {
+			fmt.Fprintf(w, "%s: %s\n", r.Name, d)
+		}
+	}
+	return nil
+}
+
+// WriteReport writes results in a machine readable format.
+func WriteReport(w io.Writer, format string, results []CloneResult) error {
+	switch format {
+	case ReportJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(results)
+	case ReportCSV:
+		return writeCSV(w, results)
+	}
+	return fmt.Errorf("Invalid report format '%s'", format)
+}
+
+func writeCSV(w io.Writer, results []CloneResult) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"name", "ip", "template", "host", "datastore", "moref",
+		"powerState", "status", "seconds", "phases", "failedPhase", "errorKind", "error",
+		"rollbackError", "action", "drift"})
+	for _, r := range results {
+		// phases as name=seconds pairs to keep one row per vm
+		var phases []string
+		for _, p := range r.Phases {
+			phases = append(phases, p.Name+"="+strconv.FormatFloat(p.Seconds, 'f', 1, 64))
+		}
+		cw.Write([]string{r.Name, r.IP, r.Template, r.Host, r.Datastore, r.MoRef,
+			r.PowerState, r.status(), strconv.FormatFloat(r.Seconds, 'f', 1, 64),
+			strings.Join(phases, ";"), r.FailedPhase, r.ErrorKind, r.Error,
+			r.RollbackError, r.Action, strings.Join(r.Drift, ";")})
+	}
+	cw.Flush()
+	return cw.Error()
+}
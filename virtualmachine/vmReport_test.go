@@ -0,0 +1,140 @@
+package virtualmachine
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sampleResults returns one successful, one rolled back and one reconciled
+// clone result.
+func sampleResults() []CloneResult {
+	return []CloneResult{
+		{
+			Name: "web-01", IP: "10.0.0.5", Template: "tlp", Host: "esx1", Datastore: "ds1", MoRef: "vm-10",
+			PowerState: "poweredOn", Seconds: 42,
+			Phases: []Phase{{Name: "clone", Seconds: 30}, {Name: "power on", Seconds: 12}},
+		},
+		{
+			Name: "web-02", IP: "10.0.0.6", Template: "tlp", Datastore: "ds1",
+			FailedPhase: "guest", ErrorKind: "timeout", Error: "wait for ip: timed out", RolledBack: true,
+		},
+		{
+			Name: "web-03", Action: ActionPlanned, Drift: []string{"vcpu: have 2, want 4"},
+		},
+	}
+}
+
+func TestWriteReportJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteReport(&buf, ReportJSON, sampleResults()); err != nil {
+		t.Fatal(err)
+	}
+	var got []map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		i     int
+		key   string
+		value interface{}
+	}{
+		{0, "moref", "vm-10"},
+		{0, "seconds", 42.0},
+		{1, "failedPhase", "guest"},
+		{1, "errorKind", "timeout"},
+		{1, "rolledBack", true},
+		{2, "action", ActionPlanned},
+	}
+	for _, tt := range tests {
+		if got[tt.i][tt.key] != tt.value {
+			t.Errorf("results[%d].%s = %v, want %v", tt.i, tt.key, got[tt.i][tt.key], tt.value)
+		}
+	}
+	if _, ok := got[0]["error"]; ok {
+		t.Error("a successful clone reports an error field")
+	}
+	if phases := got[0]["phases"].([]interface{}); len(phases) != 2 {
+		t.Errorf("phases %v", phases)
+	}
+}
+
+func TestWriteReportCSV(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteReport(&buf, ReportCSV, sampleResults()); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 4 {
+		t.Fatalf("%d rows, want a header and 3 results", len(rows))
+	}
+	col := make(map[string]int)
+	for i, name := range rows[0] {
+		col[name] = i
+	}
+	tests := []struct {
+		row   int
+		col   string
+		value string
+	}{
+		{1, "name", "web-01"},
+		{1, "status", "ok"},
+		{1, "phases", "clone=30.0;power on=12.0"},
+		{1, "seconds", "42.0"},
+		{2, "status", "rolled back"},
+		{2, "failedPhase", "guest"},
+		{2, "error", "wait for ip: timed out"},
+		{3, "status", ActionPlanned},
+		{3, "drift", "vcpu: have 2, want 4"},
+	}
+	for _, tt := range tests {
+		i, ok := col[tt.col]
+		if !ok {
+			t.Fatalf("no %s column in %v", tt.col, rows[0])
+		}
+		if got := rows[tt.row][i]; got != tt.value {
+			t.Errorf("row %d %s = %q, want %q", tt.row, tt.col, got, tt.value)
+		}
+	}
+}
+
+func TestWriteReportFormat(t *testing.T) {
+	err := WriteReport(&bytes.Buffer{}, "xml", nil)
+	checkErr(t, err, "Invalid report format 'xml'")
+}
+
+func TestWriteSummary(t *testing.T) {
+	results := sampleResults()
+	results[0].Duration = 42 * time.Second
+	var buf bytes.Buffer
+	if err := WriteSummary(&buf, results); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{"42s", "rolled back (guest)", "2 ok, 1 failed", "web-02: wait for ip: timed out", "web-03: vcpu: have 2, want 4"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("summary lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestPhase(t *testing.T) {
+	r := newCloneResult(&virtualMachine{name: "vm", networkInterfaces: []networkInterface{{ipv4Address: "10.0.0.5"}}})
+	if err := r.phase("clone", func() error { return nil }); err != nil || r.Failed() {
+		t.Fatalf("successful phase failed the result: %v", err)
+	}
+	err := r.phase("guest", func() error { return newError(ErrTimeout, "vm", "wait for ip", errors.New("timed out")) })
+	if err == nil || r.FailedPhase != "guest" || r.ErrorKind != ErrTimeout.String() || !r.Failed() {
+		t.Errorf("failed phase recorded as %+v", r)
+	}
+	if len(r.Phases) != 2 || r.IP != "10.0.0.5" {
+		t.Errorf("result %+v", r)
+	}
+}
@@ -0,0 +1,156 @@
+package virtualmachine
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"golang.org/x/net/context"
+)
+
+// SpecInfo describes a customization spec stored in vCenter.
+type SpecInfo struct {
+	Name        string
+	Type        string // Linux or Windows
+	Description string
+	LastUpdate  time.Time
+}
+
+// specName returns the name of the vCenter customization spec vm is based
+// on, empty when the spec is built from the vm fields alone.
+func (vm *virtualMachine) specName() string {
+	if v, ok := vm.customizationSpecification["name"]; ok {
+		if name, ok := v.(string); ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// namedCustomizationSpec reads the vCenter spec of vm and overlays the
+// host name and the ip settings of vm on it.
+func (vm *virtualMachine) namedCustomizationSpec(ctx context.Context, c *govmomi.Client, nics int) (*types.CustomizationSpec, error) {
+	specManager := object.NewCustomizationSpecManager(c.Client)
+	item, err := specManager.GetCustomizationSpec(ctx, vm.specName())
+	if err != nil {
+		return nil, newError(ErrUnknown, vm.name, "get customization spec "+vm.specName(), err)
+	}
+	spec := item.Spec
+
+	hostName := &types.CustomizationFixedName{Name: vm.hostName()}
+	switch id := spec.Identity.(type) {
+	case *types.CustomizationLinuxPrep:
+		id.HostName = hostName
+	case *types.CustomizationSysprep:
+		id.UserData.ComputerName = &types.CustomizationFixedName{Name: computerName(hostName.Name)}
+	}
+
+	// the spec nics keep their settings unless vm sets a static ip
+	settings, err := vm.nicSettings(nics)
+	if err != nil {
+		return nil, newError(ErrInvalidSpec, vm.name, "overlay customization spec", err)
+	}
+	for i := range settings {
+		if i < len(spec.NicSettingMap) && (i >= len(vm.networkInterfaces) || !vm.networkInterfaces[i].static()) {
+			settings[i] = spec.NicSettingMap[i]
+		}
+	}
+	spec.NicSettingMap = settings
+	return &spec, nil
+}
+
+// ListSpecs returns the customization specs stored in vCenter.
+func ListSpecs(ctx context.Context, c *Config) ([]SpecInfo, error) {
+	client, err := c.Client(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	specManager := object.NewCustomizationSpecManager(client.Client)
+	var msm mo.CustomizationSpecManager
+	if err := specManager.Properties(ctx, specManager.Reference(), []string{"info"}, &msm); err != nil {
+		return nil, newError(ErrUnknown, "", "list customization specs", err)
+	}
+
+	var specs []SpecInfo
+	for _, info := range msm.Info {
+		s := SpecInfo{Name: info.Name, Type: info.Type, Description: info.Description}
+		if info.LastUpdateTime != nil {
+			s.LastUpdate = *info.LastUpdateTime
+		}
+		specs = append(specs, s)
+	}
+	return specs, nil
+}
+
+// ExportSpec writes the customization spec name to w in the xml format
+// of the vSphere client. Passwords stay encrypted with the key of the
+// vCenter they came from.
+func ExportSpec(ctx context.Context, c *Config, name string, w io.Writer) error {
+	client, err := c.Client(ctx)
+	if err != nil {
+		return err
+	}
+
+	specManager := object.NewCustomizationSpecManager(client.Client)
+	item, err := specManager.GetCustomizationSpec(ctx, name)
+	if err != nil {
+		return newError(ErrUnknown, "", "get customization spec "+name, err)
+	}
+	xml, err := specManager.CustomizationSpecItemToXml(ctx, *item)
+	if err != nil {
+		return newError(ErrUnknown, "", "export customization spec "+name, err)
+	}
+	_, err = io.WriteString(w, xml)
+	return err
+}
+
+// ImportSpec creates a customization spec from the xml read from r, named
+// name when not empty. An existing spec of that name is only replaced
+// when overwrite is set.
+func ImportSpec(ctx context.Context, c *Config, r io.Reader, name string, overwrite bool) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	client, err := c.Client(ctx)
+	if err != nil {
+		return err
+	}
+
+	specManager := object.NewCustomizationSpecManager(client.Client)
+	item, err := specManager.XmlToCustomizationSpecItem(ctx, string(data))
+	if err != nil {
+		return newError(ErrInvalidSpec, "", "parse customization spec", err)
+	}
+	if name != "" {
+		item.Info.Name = name
+	}
+
+	exists, err := specManager.DoesCustomizationSpecExist(ctx, item.Info.Name)
+	if err != nil {
+		return newError(ErrUnknown, "", "check customization spec "+item.Info.Name, err)
+	}
+	switch {
+	case exists && !overwrite:
+		return newError(ErrInvalidSpec, "", "import customization spec",
+			fmt.Errorf("spec %s already exists", item.Info.Name))
+	case exists:
+		// vCenter refuses an overwrite without the current change version
+		current, err := specManager.GetCustomizationSpec(ctx, item.Info.Name)
+		if err != nil {
+			return newError(ErrUnknown, "", "get customization spec "+item.Info.Name, err)
+		}
+		item.Info.ChangeVersion = current.Info.ChangeVersion
+		err = specManager.OverwriteCustomizationSpec(ctx, *item)
+		return newError(ErrUnknown, "", "overwrite customization spec "+item.Info.Name, err)
+	}
+	err = specManager.CreateCustomizationSpec(ctx, *item)
+	return newError(ErrUnknown, "", "create customization spec "+item.Info.Name, err)
+}